@@ -0,0 +1,174 @@
+// apt-s3 publishes the repository configured by the environment variables of
+// the Lambda function, from CI or by hand.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/yseto/apt-s3/lambda/config"
+	"github.com/yseto/apt-s3/lambda/packages"
+	"github.com/yseto/apt-s3/lambda/publish"
+	"github.com/yseto/apt-s3/lambda/serve"
+)
+
+const usage = `usage: apt-s3 <command> [arguments]
+
+commands:
+  add <deb>...                                 add the package files
+  remove [-arch <arch>] <package> [<version>]  remove the packages from the distribution
+  regenerate [-repair]                         generate the indexes from the pool
+  sign                                         sign Release again
+  verify                                       verify the signatures, the indexes and the pool
+  list                                         list the packages of the distribution
+  serve [-addr <addr>] [-upload]               serve the repository over HTTP, and add the packages PUT
+`
+
+var (
+	commands = []string{"add", "remove", "regenerate", "sign", "verify", "list", "serve"}
+	errUsage = errors.New("invalid arguments")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err := run(ctx, flag.Arg(0), flag.Args()[1:])
+	if errors.Is(err, errUsage) {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, command string, args []string) error {
+	if !slices.Contains(commands, command) {
+		return errUsage
+	}
+
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	arch := flags.String("arch", "", "architecture of the packages to remove")
+	repair := flags.Bool("repair", false, "fix only the entries which do not match the pool")
+	addr := flags.String("addr", "localhost:8080", "address to serve on")
+	upload := flags.Bool("upload", false, "add the packages PUT or POSTed")
+	if err := flags.Parse(args); err != nil {
+		return errUsage
+	}
+	args = flags.Args()
+
+	aptConfig, err := config.Load()
+	if err != nil {
+		return err
+	}
+
+	r, err := publish.New(ctx, aptConfig)
+	if err != nil {
+		return err
+	}
+
+	switch command {
+	case "add":
+		if len(args) == 0 {
+			return errUsage
+		}
+		return r.Upload(ctx, args)
+	case "remove":
+		if len(args) == 0 || len(args) > 2 {
+			return errUsage
+		}
+		filter := packages.Filter{Package: args[0], Architecture: *arch}
+		if len(args) == 2 {
+			filter.Version = args[1]
+		}
+		return r.Remove(ctx, []packages.Filter{filter})
+	case "regenerate":
+		if *repair || aptConfig.Repair {
+			return r.Repair(ctx)
+		}
+		return r.Regenerate(ctx)
+	case "sign":
+		return r.Sign(ctx)
+	case "verify":
+		return r.Verify(ctx)
+	case "list":
+		list, err := r.List(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		for _, entry := range list {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", entry.Values["Package"], entry.Values["Version"], entry.Values["Architecture"], entry.Filename)
+		}
+		return w.Flush()
+	case "serve":
+		h := &serve.Handler{FS: r.FS}
+		if *upload {
+			h.Upload = func(ctx context.Context, name string, body io.Reader) error {
+				return receive(ctx, r, name, body)
+			}
+		}
+		return listenAndServe(ctx, *addr, h)
+	}
+	return errUsage
+}
+
+// receive adds the package uploaded as name, through a temporary file.
+func receive(ctx context.Context, r *publish.Repository, name string, body io.Reader) error {
+	dir, err := os.MkdirTemp("", "apt-s3")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	f, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, body); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return r.Upload(ctx, []string{f.Name()})
+}
+
+// listenAndServe serves h until ctx is canceled.
+func listenAndServe(ctx context.Context, addr string, h http.Handler) error {
+	srv := &http.Server{Addr: addr, Handler: h}
+	shutdown := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		shutdown <- srv.Shutdown(context.Background())
+	}()
+
+	fmt.Printf("serve on http://%s/\n", addr)
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return <-shutdown
+}
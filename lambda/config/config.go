@@ -1,9 +1,14 @@
 package config
 
 import (
+	"cmp"
+	"fmt"
+	"path"
 	"path/filepath"
+	"time"
 
 	"github.com/caarlos0/env/v11"
+	"github.com/yseto/apt-s3/lambda/storage"
 )
 
 type Config struct {
@@ -17,9 +22,140 @@ type Config struct {
 	Components  string `env:"APT_COMPONENTS"`
 	Description string `env:"APT_DESCRIPTION"`
 
+	// URLs of s3://, gs://, az:// or file://.
 	PrivateKeyS3Url string `env:"APT_PRIVATE_KEY_S3URL"`
 	LockKeyS3Url    string `env:"APT_LOCK_KEY_S3URL"`
-	DestS3Bucket    string `env:"APT_S3BUCKET"`
+	// the bucket, or the container of Azure.
+	DestS3Bucket string `env:"APT_S3BUCKET"`
+
+	// "s3", "gcs" and "azure" store the repository in APT_S3BUCKET, "local"
+	// in the directory APT_STORAGE_DIR.
+	Storage    string `env:"APT_STORAGE" envDefault:"s3"`
+	StorageDir string `env:"APT_STORAGE_DIR"`
+
+	// the account of Azure Blob Storage, or Azurite.
+	AzureConnectionString string `env:"AZURE_STORAGE_CONNECTION_STRING"`
+
+	// "s3" locks with the lockfile APT_LOCK_KEY_S3URL, in any storage,
+	// "dynamodb" locks with an item of APT_LOCK_TABLE.
+	LockBackend string `env:"APT_LOCK_BACKEND" envDefault:"s3"`
+	LockTable   string `env:"APT_LOCK_TABLE"`
+	LockScope   string `env:"APT_LOCK_SCOPE" envDefault:"repository"`
+
+	// the lease is renewed while the lock is held, so it is shorter than the
+	// processing and only bounds how long a crashed holder blocks the
+	// others. an expired lock may be broken by a waiter.
+	LockLease time.Duration `env:"APT_LOCK_LEASE" envDefault:"3m"`
+	// written into the lockfile. the Lambda request ID, or the hostname and
+	// the process ID when empty.
+	LockOwner string `env:"APT_LOCK_OWNER"`
+
+	Repair bool `env:"APT_REPAIR"`
+	// repair and regenerate add the pool files of the component which no
+	// distribution refers to, as the removed packages are kept in the pool.
+	RepairMissing bool `env:"APT_REPAIR_MISSING"`
+	Concurrency   int  `env:"APT_CONCURRENCY" envDefault:"8"`
+
+	// Cache-Control of the pool and by-hash files, which are never changed,
+	// and of Release, InRelease and Packages, which are replaced.
+	ImmutableCacheControl string `env:"APT_CACHE_CONTROL_IMMUTABLE" envDefault:"public, max-age=31536000, immutable"`
+	IndexCacheControl     string `env:"APT_CACHE_CONTROL_INDEX" envDefault:"no-cache"`
+	// added to the metadata of the files written, as key:value,key:value.
+	Metadata map[string]string `env:"APT_METADATA"`
+
+	// server-side encryption and storage class of every file in S3, and by
+	// class with the prefixes APT_POOL_, APT_INDEX_ and APT_LOCK_.
+	Objects      Objects `envPrefix:"APT_"`
+	PoolObjects  Objects `envPrefix:"APT_POOL_"`
+	IndexObjects Objects `envPrefix:"APT_INDEX_"`
+	LockObjects  Objects `envPrefix:"APT_LOCK_"`
+
+	// files larger than APT_COPY_THRESHOLD bytes are copied into the pool of
+	// S3 in parts of APT_COPY_PART_SIZE bytes. the defaults when zero.
+	CopyThreshold int64 `env:"APT_COPY_THRESHOLD"`
+	CopyPartSize  int64 `env:"APT_COPY_PART_SIZE"`
+
+	// the S3 client of every bucket, APT_S3_ENDPOINT and so on.
+	S3 S3Client `envPrefix:"APT_"`
+	// the S3 clients of the buckets uploaded packages are in, of the private
+	// key and the lockfile, and of the repository, which may be in other
+	// accounts or regions. APT_S3_* and the default AWS config for the fields
+	// not set.
+	SourceS3     S3Client `envPrefix:"APT_SOURCE_"`
+	ConfigS3     S3Client `envPrefix:"APT_CONFIG_"`
+	RepositoryS3 S3Client `envPrefix:"APT_REPOSITORY_"`
+
+	// request the checksum which uploaders stored in S3, and verify it.
+	UseS3Checksum bool `env:"APT_USE_S3_CHECKSUM"`
+}
+
+type Objects struct {
+	ServerSideEncryption string `env:"SSE"`
+	SSEKMSKeyID          string `env:"SSE_KMS_KEY_ID"`
+	StorageClass         string `env:"STORAGE_CLASS"`
+}
+
+// S3Client is the config of a S3 client.
+type S3Client struct {
+	Region   string `env:"S3_REGION"`
+	Endpoint string `env:"S3_ENDPOINT"`
+	// the role assumed with the default credentials.
+	RoleARN string `env:"S3_ROLE_ARN"`
+
+	// path-style addressing when not set, for MinIO and LocalStack.
+	PathStyle *bool `env:"S3_PATH_STYLE"`
+	// "standard" or "adaptive", and the attempts of a request.
+	RetryMode   string `env:"S3_RETRY_MODE"`
+	MaxAttempts int    `env:"S3_MAX_ATTEMPTS"`
+	// what the SDK logs, as retries,request,response,request_with_body,
+	// response_with_body,signing.
+	LogMode []string `env:"S3_LOG_MODE"`
+}
+
+// Or returns c, with the fields not set in c from base.
+func (c S3Client) Or(base S3Client) S3Client {
+	c.Region = cmp.Or(c.Region, base.Region)
+	c.Endpoint = cmp.Or(c.Endpoint, base.Endpoint)
+	c.RoleARN = cmp.Or(c.RoleARN, base.RoleARN)
+	if c.PathStyle == nil {
+		c.PathStyle = base.PathStyle
+	}
+	c.RetryMode = cmp.Or(c.RetryMode, base.RetryMode)
+	c.MaxAttempts = cmp.Or(c.MaxAttempts, base.MaxAttempts)
+	if len(c.LogMode) == 0 {
+		c.LogMode = base.LogMode
+	}
+	return c
+}
+
+// lock scopes. a narrower scope lets other distributions, or components,
+// publish concurrently.
+const (
+	LockScopeRepository   = "repository"
+	LockScopeDistribution = "distribution"
+	LockScopeComponent    = "component"
+)
+
+// Policy returns the headers and the metadata of the files written.
+func (cfg *Config) Policy() *storage.Policy {
+	return &storage.Policy{
+		ImmutableCacheControl: cfg.ImmutableCacheControl,
+		IndexCacheControl:     cfg.IndexCacheControl,
+		Metadata:              cfg.Metadata,
+		Options:               storage.Options(cfg.Objects),
+		Classes: map[storage.Class]storage.Options{
+			storage.ClassPool:  storage.Options(cfg.PoolObjects),
+			storage.ClassIndex: storage.Options(cfg.IndexObjects),
+			storage.ClassLock:  storage.Options(cfg.LockObjects),
+		},
+	}
+}
+
+// LockPolicy returns the policy of the lockfile.
+func (cfg *Config) LockPolicy() *storage.Policy {
+	p := cfg.Policy()
+	p.Class = storage.ClassLock
+	return p
 }
 
 func Load() (Config, error) {
@@ -33,3 +169,17 @@ func (cfg *Config) DistributionDirName() string {
 func (cfg *Config) DirName() string {
 	return filepath.Join(cfg.BaseDir, "dists", cfg.Distribution, cfg.Components)
 }
+
+// LockName returns the name of the lock following LockScope, which is empty
+// for the whole repository.
+func (cfg *Config) LockName() (string, error) {
+	switch cfg.LockScope {
+	case LockScopeRepository:
+		return "", nil
+	case LockScopeDistribution:
+		return cfg.Distribution, nil
+	case LockScopeComponent:
+		return path.Join(cfg.Distribution, cfg.Components), nil
+	}
+	return "", fmt.Errorf("unknown lock scope: %s", cfg.LockScope)
+}
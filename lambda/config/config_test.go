@@ -0,0 +1,65 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockLease(t *testing.T) {
+	t.Setenv("APT_LOCK_LEASE", "")
+	cfg, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.LockLease != 3*time.Minute {
+		t.Fatalf("default LockLease: %s", cfg.LockLease)
+	}
+
+	t.Setenv("APT_LOCK_LEASE", "90s")
+	cfg, err = Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.LockLease != 90*time.Second {
+		t.Fatalf("LockLease: %s", cfg.LockLease)
+	}
+}
+
+func TestLockName(t *testing.T) {
+	for scope, want := range map[string]string{
+		LockScopeRepository:   "",
+		LockScopeDistribution: "stable",
+		LockScopeComponent:    "stable/main",
+	} {
+		cfg := Config{Distribution: "stable", Components: "main", LockScope: scope}
+		got, err := cfg.LockName()
+		if err != nil || got != want {
+			t.Errorf("%s: got %q, %v, want %q", scope, got, err, want)
+		}
+	}
+
+	cfg := Config{Distribution: "stable", Components: "main", LockScope: "bucket"}
+	if _, err := cfg.LockName(); err == nil {
+		t.Error("unknown lock scope is accepted")
+	}
+}
+
+func TestLockScope(t *testing.T) {
+	t.Setenv("APT_LOCK_SCOPE", "")
+	cfg, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.LockScope != LockScopeRepository {
+		t.Fatalf("default LockScope: %q", cfg.LockScope)
+	}
+
+	t.Setenv("APT_LOCK_SCOPE", "component")
+	cfg, err = Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.LockScope != LockScopeComponent {
+		t.Fatalf("LockScope: %q", cfg.LockScope)
+	}
+}
@@ -0,0 +1,184 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/cenkalti/backoff/v5"
+)
+
+// DynamoDB holds the lock as an item of a table, whose partition key is
+// `LockKey` (string). Enable TTL on `ExpiresAt` to remove expired items.
+type DynamoDB struct {
+	client     *dynamodb.Client
+	table, key string
+	lease      time.Duration
+	owner      Owner
+
+	// the lock we hold, updated by the renewer.
+	state   lockState
+	version int64
+
+	renewer
+}
+
+var _ Locker = (*DynamoDB)(nil)
+
+func NewDynamoDB(client *dynamodb.Client, table, key string, lease time.Duration, owner Owner) *DynamoDB {
+	return &DynamoDB{
+		client: client,
+		table:  table,
+		key:    key,
+		lease:  lease,
+		owner:  owner,
+	}
+}
+
+func (l *DynamoDB) GetLock(ctx context.Context) (err error) {
+	owner, err := l.owner(ctx)
+	if err != nil {
+		return
+	}
+
+	putItem := func() (string, error) {
+		state := lockState{
+			Owner:        owner,
+			AcquiredAt:   time.Now().UTC(),
+			LeaseSeconds: int64(l.lease / time.Second),
+		}
+
+		// an expired lock is replaced in the same request.
+		_, err := l.client.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName:           aws.String(l.table),
+			Item:                l.item(state, 1),
+			ConditionExpression: aws.String("attribute_not_exists(LockKey) OR ExpiresAt < :now"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":now": number(time.Now().Unix()),
+			},
+			ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+		})
+		if err != nil {
+			fmt.Println("retry", err)
+			var failed *types.ConditionalCheckFailedException
+			if errors.As(err, &failed) {
+				held := parseItem(failed.Item)
+				fmt.Printf("lock is held by %s since %s, expires at %s\n", held.Owner, held.AcquiredAt.Format(time.RFC3339), held.expiresAt().Format(time.RFC3339))
+			}
+			return "", err
+		}
+
+		l.state = state
+		l.version = 1
+		return "", nil
+	}
+
+	_, err = backoff.Retry(ctx, putItem, backoff.WithBackOff(backoff.NewExponentialBackOff()), backoff.WithMaxTries(100))
+
+	return
+}
+
+func (l *DynamoDB) KeepAlive(ctx context.Context) context.Context {
+	return l.start(ctx, l.lease, func(ctx context.Context) (bool, error) {
+		err := l.renew(ctx)
+		var failed *types.ConditionalCheckFailedException
+		// retry until the lease expires, unless the lock was taken.
+		return err != nil && (errors.As(err, &failed) || time.Now().After(l.state.expiresAt())), err
+	})
+}
+
+func (l *DynamoDB) renew(ctx context.Context) error {
+	state := l.state
+	state.RenewedAt = time.Now().UTC()
+
+	_, err := l.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(l.table),
+		Key:                 l.itemKey(),
+		UpdateExpression:    aws.String("SET RenewedAt = :renewed, ExpiresAt = :expires, Version = :next"),
+		ConditionExpression: aws.String("#owner = :owner AND Version = :version"),
+		ExpressionAttributeNames: map[string]string{
+			"#owner": "Owner",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":renewed": timestamp(state.RenewedAt),
+			":expires": number(state.expiresAt().Unix()),
+			":next":    number(l.version + 1),
+			":owner":   &types.AttributeValueMemberS{Value: state.Owner},
+			":version": number(l.version),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	l.state = state
+	l.version++
+	return nil
+}
+
+func (l *DynamoDB) UnLock(ctx context.Context) error {
+	l.halt()
+
+	_, err := l.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:           aws.String(l.table),
+		Key:                 l.itemKey(),
+		ConditionExpression: aws.String("#owner = :owner AND Version = :version"),
+		ExpressionAttributeNames: map[string]string{
+			"#owner": "Owner",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":owner":   &types.AttributeValueMemberS{Value: l.state.Owner},
+			":version": number(l.version),
+		},
+	})
+	var failed *types.ConditionalCheckFailedException
+	if errors.As(err, &failed) {
+		return fmt.Errorf("lock ID does not match: %w", err)
+	}
+	return err
+}
+
+func (l *DynamoDB) itemKey() map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"LockKey": &types.AttributeValueMemberS{Value: l.key},
+	}
+}
+
+func (l *DynamoDB) item(state lockState, version int64) map[string]types.AttributeValue {
+	item := l.itemKey()
+	item["Owner"] = &types.AttributeValueMemberS{Value: state.Owner}
+	item["AcquiredAt"] = timestamp(state.AcquiredAt)
+	item["LeaseSeconds"] = number(state.LeaseSeconds)
+	item["ExpiresAt"] = number(state.expiresAt().Unix())
+	item["Version"] = number(version)
+	return item
+}
+
+func parseItem(item map[string]types.AttributeValue) (state lockState) {
+	if v, ok := item["Owner"].(*types.AttributeValueMemberS); ok {
+		state.Owner = v.Value
+	}
+	if v, ok := item["AcquiredAt"].(*types.AttributeValueMemberS); ok {
+		state.AcquiredAt, _ = time.Parse(time.RFC3339Nano, v.Value)
+	}
+	if v, ok := item["RenewedAt"].(*types.AttributeValueMemberS); ok {
+		state.RenewedAt, _ = time.Parse(time.RFC3339Nano, v.Value)
+	}
+	if v, ok := item["LeaseSeconds"].(*types.AttributeValueMemberN); ok {
+		state.LeaseSeconds, _ = strconv.ParseInt(v.Value, 10, 64)
+	}
+	return
+}
+
+func number(n int64) types.AttributeValue {
+	return &types.AttributeValueMemberN{Value: strconv.FormatInt(n, 10)}
+}
+
+func timestamp(t time.Time) types.AttributeValue {
+	return &types.AttributeValueMemberS{Value: t.Format(time.RFC3339Nano)}
+}
@@ -0,0 +1,149 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/docker/go-connections/nat"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/modules/localstack"
+)
+
+func dynamodbHelper(t *testing.T) *dynamodb.Client {
+	t.Helper()
+	testcontainers.SkipIfProviderIsNotHealthy(t)
+
+	ctx := t.Context()
+
+	localstackContainer, err := localstack.Run(
+		ctx,
+		"localstack/localstack:4.3",
+		testcontainers.WithEnv(map[string]string{"SERVICES": "dynamodb"}),
+	)
+	testcontainers.CleanupContainer(t, localstackContainer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	localstackPort, err := localstackContainer.MappedPort(ctx, nat.Port("4566/tcp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := dynamodb.New(dynamodb.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String("http://localhost:" + localstackPort.Port()),
+		Credentials:  credentials.NewStaticCredentialsProvider("DUMMY", "DUMMY", ""),
+	})
+
+	_, err = client.CreateTable(ctx, &dynamodb.CreateTableInput{
+		TableName: aws.String("lock"),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("LockKey"), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("LockKey"), KeyType: types.KeyTypeHash},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client
+}
+
+func TestDynamoDB(t *testing.T) {
+	client := dynamodbHelper(t)
+
+	t.Run("lock", func(t *testing.T) {
+		a := NewDynamoDB(client, "lock", "repository", time.Minute, TokenOwner("a"))
+		b := NewDynamoDB(client, "lock", "repository", time.Minute, TokenOwner("b"))
+
+		if err := a.GetLock(t.Context()); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(t.Context(), time.Second)
+		defer cancel()
+		if err := b.GetLock(ctx); err == nil {
+			t.Fatal("lock is acquired twice")
+		}
+
+		// another key is not locked.
+		c := NewDynamoDB(client, "lock", "another", time.Minute, TokenOwner("c"))
+		if err := c.GetLock(t.Context()); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.UnLock(t.Context()); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := a.UnLock(t.Context()); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.GetLock(t.Context()); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.UnLock(t.Context()); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		a := NewDynamoDB(client, "lock", "expired", time.Second, TokenOwner("a"))
+		b := NewDynamoDB(client, "lock", "expired", time.Second, TokenOwner("b"))
+
+		if err := a.GetLock(t.Context()); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.GetLock(t.Context()); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.UnLock(t.Context()); err == nil {
+			t.Fatal("lock is released by another owner")
+		}
+		if err := b.UnLock(t.Context()); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("keep alive", func(t *testing.T) {
+		a := NewDynamoDB(client, "lock", "renewed", 3*time.Second, TokenOwner("a"))
+		b := NewDynamoDB(client, "lock", "renewed", 3*time.Second, TokenOwner("b"))
+
+		if err := a.GetLock(t.Context()); err != nil {
+			t.Fatal(err)
+		}
+		workCtx := a.KeepAlive(t.Context())
+
+		ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+		defer cancel()
+		if err := b.GetLock(ctx); err == nil {
+			t.Fatal("lock is broken while it is renewed")
+		}
+
+		// the lock is overwritten by someone else.
+		c := NewDynamoDB(client, "lock", "renewed", time.Minute, TokenOwner("c"))
+		if _, err := client.PutItem(t.Context(), &dynamodb.PutItemInput{
+			TableName: aws.String("lock"),
+			Item:      c.item(lockState{Owner: "c", AcquiredAt: time.Now()}, 1),
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		<-workCtx.Done()
+		if !errors.Is(context.Cause(workCtx), ErrLockLost) {
+			t.Fatal(context.Cause(workCtx))
+		}
+		if err := a.UnLock(t.Context()); err == nil {
+			t.Fatal("lock is released by another owner")
+		}
+	})
+}
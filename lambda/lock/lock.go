@@ -1,112 +1,234 @@
 package lock
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"net/url"
-	"strings"
+	"os"
+	"time"
 
 	"github.com/aws/aws-lambda-go/lambdacontext"
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/cenkalti/backoff/v5"
+	"github.com/yseto/apt-s3/lambda/storage"
 )
 
+var ErrLockLost = errors.New("lock lost")
+
+// Locker serializes the writes to the repository.
+type Locker interface {
+	GetLock(ctx context.Context) error
+	// KeepAlive renews the lease in background until UnLock. The returned
+	// context is canceled with ErrLockLost when the lock can not be renewed.
+	KeepAlive(ctx context.Context) context.Context
+	UnLock(ctx context.Context) error
+}
+
 type lockState struct {
-	AwsRequestID string `json:"AwsRequestID"`
+	Owner        string    `json:"Owner"`
+	AwsRequestID string    `json:"AwsRequestID,omitempty"` // written by older versions
+	AcquiredAt   time.Time `json:"AcquiredAt"`
+	RenewedAt    time.Time `json:"RenewedAt,omitzero"`
+	LeaseSeconds int64     `json:"LeaseSeconds"`
 }
 
-func fromContext(ctx context.Context) (*lambdacontext.LambdaContext, bool) {
-	lc, ok := lambdacontext.FromContext(ctx)
-	return lc, ok
+func (s lockState) expiresAt() time.Time {
+	from := s.AcquiredAt
+	if s.RenewedAt.After(from) {
+		from = s.RenewedAt
+	}
+	return from.Add(time.Duration(s.LeaseSeconds) * time.Second)
 }
 
-type Lock struct {
-	s3Client    *s3.Client
-	bucket, key string
+// Owner identifies who holds the lock.
+type Owner func(ctx context.Context) (string, error)
+
+// LambdaOwner uses the request ID of the Lambda invocation.
+func LambdaOwner(ctx context.Context) (string, error) {
+	lc, ok := lambdacontext.FromContext(ctx)
+	if !ok {
+		return "", errors.New("can not get lambda context")
+	}
+	return lc.AwsRequestID, nil
 }
 
-func New(s3Client *s3.Client, s3url string) (*Lock, error) {
-	u, err := url.Parse(s3url)
+// ProcessOwner uses the hostname and the process ID.
+func ProcessOwner(ctx context.Context) (string, error) {
+	hostname, err := os.Hostname()
 	if err != nil {
-		return nil, err
+		return "", err
 	}
+	return fmt.Sprintf("%s:%d", hostname, os.Getpid()), nil
+}
 
-	return &Lock{
-		s3Client: s3Client,
-		bucket:   u.Host,
-		key:      strings.TrimPrefix(u.Path, "/"),
-	}, nil
+// TokenOwner uses a token given by the caller.
+func TokenOwner(token string) Owner {
+	return func(context.Context) (string, error) {
+		return token, nil
+	}
 }
 
-func (l *Lock) GetLock(ctx context.Context) (err error) {
-	lc, ok := fromContext(ctx)
-	if !ok {
-		return errors.New("can not get lambda context")
+// DefaultOwner uses the Lambda request ID, or the process outside Lambda.
+func DefaultOwner(ctx context.Context) (string, error) {
+	if _, ok := lambdacontext.FromContext(ctx); ok {
+		return LambdaOwner(ctx)
+	}
+	return ProcessOwner(ctx)
+}
+
+// Lock is a lockfile, written with conditional requests.
+type Lock struct {
+	fs    storage.Impl
+	key   string
+	lease time.Duration
+	owner Owner
+
+	// the lock we hold, updated by the renewer.
+	state lockState
+	etag  string
+
+	renewer
+}
+
+var _ Locker = (*Lock)(nil)
+
+func New(fs storage.Impl, key string, lease time.Duration, owner Owner) *Lock {
+	return &Lock{
+		fs:    fs,
+		key:   key,
+		lease: lease,
+		owner: owner,
 	}
+}
 
-	b, err := json.Marshal(lockState{AwsRequestID: lc.AwsRequestID})
+func (l *Lock) GetLock(ctx context.Context) (err error) {
+	owner, err := l.owner(ctx)
 	if err != nil {
 		return
 	}
 
-	input := &s3.PutObjectInput{
-		ContentType: aws.String("application/json"),
-		Body:        bytes.NewReader(b),
-		Bucket:      aws.String(l.bucket),
-		Key:         aws.String(l.key),
-		IfNoneMatch: aws.String("*"),
-	}
+	writeFile := func() (string, error) {
+		state := lockState{
+			Owner:        owner,
+			AcquiredAt:   time.Now().UTC(),
+			LeaseSeconds: int64(l.lease / time.Second),
+		}
+		b, err := json.Marshal(state)
+		if err != nil {
+			return "", backoff.Permanent(err)
+		}
 
-	putObject := func() (string, error) {
-		_, err = l.s3Client.PutObject(ctx, input)
+		etag, err := l.fs.WriteFileIf(ctx, l.key, b, nil, storage.Condition{IfNoneMatch: true})
 		if err != nil {
 			fmt.Println("retry", err)
+			if storage.IsConditionFailed(err) {
+				if errB := l.breakExpired(ctx); errB != nil {
+					fmt.Println("can not break lock", errB)
+				}
+			}
+			return "", err
 		}
-		return "", err
+
+		l.state = state
+		l.etag = etag
+		return "", nil
 	}
 
-	_, err = backoff.Retry(ctx, putObject, backoff.WithBackOff(backoff.NewExponentialBackOff()), backoff.WithMaxTries(100))
+	_, err = backoff.Retry(ctx, writeFile, backoff.WithBackOff(backoff.NewExponentialBackOff()), backoff.WithMaxTries(100))
 
 	return
 }
 
-func (l *Lock) UnLock(ctx context.Context) (err error) {
-	state, err := l.s3Client.GetObject(ctx, &s3.GetObjectInput{
-		Bucket: aws.String(l.bucket),
-		Key:    aws.String(l.key),
-	})
+// breakExpired removes the lockfile when its lease has expired. The delete is
+// conditional on the ETag, so a lock taken by another waiter in the meantime
+// is kept.
+func (l *Lock) breakExpired(ctx context.Context) error {
+	state, etag, err := l.read(ctx)
+	if storage.IsNotExist(err) {
+		return nil
+	}
 	if err != nil {
-		return
+		return err
+	}
+
+	expiresAt := state.expiresAt()
+	fmt.Printf("lock is held by %s since %s, expires at %s\n", state.Owner, state.AcquiredAt.Format(time.RFC3339), expiresAt.Format(time.RFC3339))
+
+	if time.Now().Before(expiresAt) {
+		return nil
 	}
-	defer state.Body.Close()
 
-	data, err := io.ReadAll(state.Body)
+	if err := l.fs.DeleteFileIf(ctx, l.key, etag); err != nil {
+		return err
+	}
+
+	fmt.Printf("break expired lock of %s\n", state.Owner)
+	return nil
+}
+
+func (l *Lock) read(ctx context.Context) (info lockState, etag string, err error) {
+	data, object, err := l.fs.GetFile(ctx, l.key)
 	if err != nil {
 		return
 	}
 
-	info := &lockState{}
-	if err = json.Unmarshal(data, info); err != nil {
+	if err = json.Unmarshal(data, &info); err != nil {
 		return
 	}
 
-	lc, ok := fromContext(ctx)
-	if !ok {
-		return errors.New("can not get lambda context")
+	// lockfile written by older versions.
+	if info.Owner == "" {
+		info.Owner = info.AwsRequestID
 	}
-
-	if info.AwsRequestID != lc.AwsRequestID {
-		return fmt.Errorf("lock ID does not match")
+	if info.AcquiredAt.IsZero() {
+		info.AcquiredAt = object.LastModified
+	}
+	if info.LeaseSeconds == 0 {
+		info.LeaseSeconds = int64(l.lease / time.Second)
 	}
 
-	_, err = l.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
-		Bucket: aws.String(l.bucket),
-		Key:    aws.String(l.key),
-	})
+	etag = object.ETag
 	return
 }
+
+func (l *Lock) KeepAlive(ctx context.Context) context.Context {
+	return l.start(ctx, l.lease, func(ctx context.Context) (bool, error) {
+		err := l.renew(ctx)
+		// retry until the lease expires, unless the lock was taken.
+		return err != nil && (storage.IsConditionFailed(err) || time.Now().After(l.state.expiresAt())), err
+	})
+}
+
+func (l *Lock) renew(ctx context.Context) error {
+	state := l.state
+	state.RenewedAt = time.Now().UTC()
+
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	etag, err := l.fs.WriteFileIf(ctx, l.key, b, nil, storage.Condition{IfMatch: l.etag})
+	if err != nil {
+		return err
+	}
+
+	l.state = state
+	l.etag = etag
+	return nil
+}
+
+func (l *Lock) UnLock(ctx context.Context) (err error) {
+	l.halt()
+
+	info, etag, err := l.read(ctx)
+	if err != nil {
+		return
+	}
+
+	if info.Owner != l.state.Owner {
+		return fmt.Errorf("lock ID does not match: %s", info.Owner)
+	}
+
+	return l.fs.DeleteFileIf(ctx, l.key, etag)
+}
@@ -0,0 +1,186 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/yseto/apt-s3/lambda/storage"
+)
+
+type fakeObject struct {
+	body     []byte
+	etag     string
+	modified time.Time
+}
+
+// fakeS3 supports the conditional requests used by Lock.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]fakeObject
+	version int
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	object, exists := f.objects[r.URL.Path]
+
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && (!exists || ifMatch != object.etag) {
+		writeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if !exists {
+			writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", object.etag)
+		w.Header().Set("Last-Modified", object.modified.Format(http.TimeFormat))
+		w.Write(object.body)
+	case http.MethodPut:
+		if r.Header.Get("If-None-Match") == "*" && exists {
+			writeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		f.put(r.URL.Path, body)
+		w.Header().Set("ETag", f.objects[r.URL.Path].etag)
+	case http.MethodDelete:
+		delete(f.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (f *fakeS3) put(path string, body []byte) {
+	f.version++
+	f.objects[path] = fakeObject{
+		body:     body,
+		etag:     fmt.Sprintf(`"%d"`, f.version),
+		modified: time.Now(),
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code></Error>", code)
+}
+
+func newLock(t *testing.T, f *fakeS3, lease time.Duration, owner string) *Lock {
+	t.Helper()
+
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	client := s3.New(s3.Options{
+		Region:                     "us-east-1",
+		BaseEndpoint:               aws.String(srv.URL),
+		UsePathStyle:               true,
+		Credentials:                aws.AnonymousCredentials{},
+		RequestChecksumCalculation: aws.RequestChecksumCalculationWhenRequired,
+	})
+
+	return New(&storage.S3{S3Client: client, BucketName: "config"}, "lockfile", lease, TokenOwner(owner))
+}
+
+func TestLock(t *testing.T) {
+	f := &fakeS3{objects: map[string]fakeObject{}}
+
+	a := newLock(t, f, time.Minute, "a")
+	b := newLock(t, f, time.Minute, "b")
+
+	if err := a.GetLock(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second)
+	defer cancel()
+	if err := b.GetLock(ctx); err == nil {
+		t.Fatal("lock is acquired twice")
+	}
+
+	if err := b.UnLock(t.Context()); err == nil {
+		t.Fatal("lock is released by another owner")
+	}
+
+	if err := a.UnLock(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.GetLock(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.UnLock(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockExpired(t *testing.T) {
+	f := &fakeS3{objects: map[string]fakeObject{}}
+
+	a := newLock(t, f, time.Second, "a")
+	b := newLock(t, f, time.Second, "b")
+
+	if err := a.GetLock(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+
+	// a has crashed, b breaks the lock after the lease.
+	if err := b.GetLock(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.UnLock(t.Context()); err == nil {
+		t.Fatal("lock is released by another owner")
+	}
+	if err := b.UnLock(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	f := &fakeS3{objects: map[string]fakeObject{}}
+
+	a := newLock(t, f, 3*time.Second, "a")
+	b := newLock(t, f, 3*time.Second, "b")
+
+	if err := a.GetLock(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	workCtx := a.KeepAlive(t.Context())
+
+	// the lease is renewed, b can not break it.
+	ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+	defer cancel()
+	if err := b.GetLock(ctx); err == nil {
+		t.Fatal("lock is broken while it is renewed")
+	}
+	if err := workCtx.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the lock is overwritten by someone else.
+	f.mu.Lock()
+	f.put("/config/lockfile", []byte(`{"Owner":"c"}`))
+	f.mu.Unlock()
+
+	<-workCtx.Done()
+	if !errors.Is(context.Cause(workCtx), ErrLockLost) {
+		t.Fatal(context.Cause(workCtx))
+	}
+
+	if err := a.UnLock(t.Context()); err == nil {
+		t.Fatal("lock is released by another owner")
+	}
+}
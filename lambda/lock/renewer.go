@@ -0,0 +1,62 @@
+package lock
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// renewer calls renew in background until it is halted.
+type renewer struct {
+	stop   chan struct{}
+	done   chan struct{}
+	cancel context.CancelCauseFunc
+}
+
+// start renews three times per lease. renew reports whether the lock is lost
+// by the error, otherwise it is retried on the next tick.
+func (r *renewer) start(ctx context.Context, lease time.Duration, renew func(ctx context.Context) (lost bool, err error)) context.Context {
+	ctx, r.cancel = context.WithCancelCause(ctx)
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+
+	go func() {
+		defer close(r.done)
+
+		ticker := time.NewTicker(max(lease/3, time.Second))
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			lost, err := renew(ctx)
+			if err == nil {
+				continue
+			}
+			fmt.Println("can not renew lock", err)
+
+			if lost {
+				r.cancel(fmt.Errorf("%w: %w", ErrLockLost, err))
+				return
+			}
+		}
+	}()
+
+	return ctx
+}
+
+func (r *renewer) halt() {
+	if r.stop == nil {
+		return
+	}
+	close(r.stop)
+	<-r.done
+	r.cancel(nil)
+	r.stop = nil
+}
@@ -26,6 +26,7 @@ type helper struct {
 
 func localstackHelper(t *testing.T) helper {
 	t.Helper()
+	testcontainers.SkipIfProviderIsNotHealthy(t)
 
 	ctx := t.Context()
 
@@ -0,0 +1,105 @@
+package packages
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// keys of the object metadata which cache a Digest.
+const (
+	metadataSize   = "apt-size"
+	metadataMD5    = "apt-md5sum"
+	metadataSHA1   = "apt-sha1"
+	metadataSHA256 = "apt-sha256"
+)
+
+type Digest struct {
+	Size   int64
+	MD5    string
+	SHA1   string
+	SHA256 string
+}
+
+func Sum(body io.Reader) (d Digest, err error) {
+	var (
+		md5hash    = md5.New()
+		sha1hash   = sha1.New()
+		sha256hash = sha256.New()
+	)
+
+	d.Size, err = io.Copy(io.MultiWriter(md5hash, sha1hash, sha256hash), body)
+	if err != nil {
+		return
+	}
+
+	d.MD5 = hex.EncodeToString(md5hash.Sum(nil))
+	d.SHA1 = hex.EncodeToString(sha1hash.Sum(nil))
+	d.SHA256 = hex.EncodeToString(sha256hash.Sum(nil))
+	return
+}
+
+func (d Digest) Metadata() map[string]string {
+	return map[string]string{
+		metadataSize:   strconv.FormatInt(d.Size, 10),
+		metadataMD5:    d.MD5,
+		metadataSHA1:   d.SHA1,
+		metadataSHA256: d.SHA256,
+	}
+}
+
+// DigestFromMetadata returns the Digest cached in object metadata, if it was
+// written for an object of the given size.
+func DigestFromMetadata(size int64, metadata map[string]string) (Digest, bool) {
+	d := Digest{
+		Size:   size,
+		MD5:    metadata[metadataMD5],
+		SHA1:   metadata[metadataSHA1],
+		SHA256: metadata[metadataSHA256],
+	}
+	if metadata[metadataSize] != strconv.FormatInt(size, 10) || d.MD5 == "" || d.SHA1 == "" || d.SHA256 == "" {
+		return Digest{}, false
+	}
+	return d, true
+}
+
+// Verify compares the digest with a base64 encoded SHA256 checksum stored by
+// S3. Composite checksums of multipart uploads can not be compared, and are
+// skipped.
+func (d Digest) Verify(checksumSHA256 string) error {
+	if checksumSHA256 == "" || strings.Contains(checksumSHA256, "-") {
+		return nil
+	}
+
+	b, err := base64.StdEncoding.DecodeString(checksumSHA256)
+	if err != nil {
+		return err
+	}
+
+	if hex.EncodeToString(b) != d.SHA256 {
+		return fmt.Errorf("sha256 does not match: %s, %s", hex.EncodeToString(b), d.SHA256)
+	}
+	return nil
+}
+
+// Writer writes a file with its object metadata, as storage.Impl does.
+type Writer interface {
+	WriteFile(ctx context.Context, name string, data []byte, metadata map[string]string) error
+}
+
+// WriteIndex writes an index file with its digest in the object metadata.
+func WriteIndex(ctx context.Context, w Writer, name string, data []byte) error {
+	d, err := Sum(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	return w.WriteFile(ctx, name, data, d.Metadata())
+}
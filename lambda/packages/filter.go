@@ -0,0 +1,39 @@
+package packages
+
+import "path"
+
+// Filter selects the entries of a `Packages` index. Each field is a glob
+// pattern, and an empty field matches any value.
+type Filter struct {
+	Package      string `json:"package,omitempty"`
+	Version      string `json:"version,omitempty"`
+	Architecture string `json:"architecture,omitempty"`
+	// Fields matches other control fields, such as `Section` or `Maintainer`.
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+func (f Filter) Match(e Entry) bool {
+	patterns := map[string]string{
+		"Package":      f.Package,
+		"Version":      f.Version,
+		"Architecture": f.Architecture,
+	}
+	for field, pattern := range f.Fields {
+		patterns[field] = pattern
+	}
+
+	for field, pattern := range patterns {
+		if pattern == "" {
+			continue
+		}
+		if ok, _ := path.Match(pattern, e.Values[field]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Key identifies the package of an entry in an index.
+func (e Entry) Key() string {
+	return e.Values["Package"] + " " + e.Values["Version"] + " " + e.Values["Architecture"]
+}
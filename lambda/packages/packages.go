@@ -2,13 +2,14 @@ package packages
 
 import (
 	"bytes"
-	"crypto/md5"
-	"crypto/sha1"
-	"crypto/sha256"
-	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/yseto/apt-s3/lambda/storage"
 
 	"pault.ag/go/debian/control"
 	"pault.ag/go/debian/deb"
@@ -20,35 +21,48 @@ type Iface interface {
 	io.Seeker
 }
 
+// ErrInvalid is returned when a file is not a package.
+var ErrInvalid = errors.New("invalid package")
+
 type Package struct {
 	ControlWithStat string
 	CPU             string
 	DestPath        string
+	Digest          Digest
 }
 
 func Load(fd Iface, components, filename string) (response Package, err error) {
-	debFile, err := deb.Load(fd, "")
-	if err != nil {
+	if _, err = fd.Seek(0, io.SeekStart); err != nil {
 		return
 	}
-	defer debFile.Close() // nolint
-
-	response.CPU = debFile.Control.Architecture.CPU
 
-	var (
-		md5hash    = md5.New()
-		sha1hash   = sha1.New()
-		sha256hash = sha256.New()
-	)
+	return LoadAt(fd, fd, components, filename)
+}
 
-	if _, err = fd.Seek(0, io.SeekStart); err != nil {
+// LoadAt reads the control data of a package through in, and computes the
+// checksums in a single pass over body, which must start at the beginning
+// of the same package.
+func LoadAt(in io.ReaderAt, body io.Reader, components, filename string) (response Package, err error) {
+	d, err := Sum(body)
+	if err != nil {
 		return
 	}
 
-	size, err := io.Copy(io.MultiWriter(md5hash, sha1hash, sha256hash), fd)
+	return LoadWithDigest(in, d, components, filename)
+}
+
+// LoadWithDigest reads the control data of a package through in, and uses a
+// digest computed before instead of reading the whole package.
+func LoadWithDigest(in io.ReaderAt, d Digest, components, filename string) (response Package, err error) {
+	debFile, err := deb.Load(in, "")
 	if err != nil {
+		err = fmt.Errorf("%w: %w", ErrInvalid, err)
 		return
 	}
+	defer debFile.Close() // nolint
+
+	response.CPU = debFile.Control.Architecture.CPU
+	response.Digest = d
 
 	basePath := filepath.Base(filename)
 
@@ -56,10 +70,10 @@ func Load(fd Iface, components, filename string) (response Package, err error) {
 	response.DestPath = destPath
 
 	debFile.Control.Paragraph.Set("Filename", destPath)
-	debFile.Control.Paragraph.Set("Size", fmt.Sprint(size))
-	debFile.Control.Paragraph.Set("MD5sum", hex.EncodeToString(md5hash.Sum(nil)))
-	debFile.Control.Paragraph.Set("SHA1", hex.EncodeToString(sha1hash.Sum(nil)))
-	debFile.Control.Paragraph.Set("SHA256", hex.EncodeToString(sha256hash.Sum(nil)))
+	debFile.Control.Paragraph.Set("Size", fmt.Sprint(d.Size))
+	debFile.Control.Paragraph.Set("MD5sum", d.MD5)
+	debFile.Control.Paragraph.Set("SHA1", d.SHA1)
+	debFile.Control.Paragraph.Set("SHA256", d.SHA256)
 
 	buf := bytes.NewBuffer([]byte{})
 	if err = control.Marshal(buf, debFile.Control); err != nil {
@@ -69,3 +83,72 @@ func Load(fd Iface, components, filename string) (response Package, err error) {
 	response.ControlWithStat = buf.String()
 	return
 }
+
+// Metadata is the cached result of Load for a pool file, keyed by the ETag
+// of the pool object it was generated from.
+type Metadata struct {
+	ETag            string `json:"etag"`
+	CPU             string `json:"cpu"`
+	ControlWithStat string `json:"control"`
+}
+
+func MetadataPath(key string) string {
+	return key + storage.MetadataSuffix
+}
+
+type Entry struct {
+	Filename string
+	Size     int64
+	MD5sum   string
+	Control  string
+	Values   map[string]string
+}
+
+// Parse splits a `Packages` index into its entries, keeping each control
+// paragraph as it was written.
+func Parse(data []byte) (entries []Entry, err error) {
+	var lines []string
+
+	flush := func() error {
+		if len(lines) == 0 {
+			return nil
+		}
+		text := strings.Join(lines, "\n") + "\n"
+		lines = nil
+
+		reader, err := control.NewParagraphReader(strings.NewReader(text), nil)
+		if err != nil {
+			return err
+		}
+		para, err := reader.Next()
+		if err != nil {
+			return err
+		}
+
+		size, err := strconv.ParseInt(para.Values["Size"], 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s: invalid Size: %w", para.Values["Filename"], err)
+		}
+
+		entries = append(entries, Entry{
+			Filename: para.Values["Filename"],
+			Size:     size,
+			MD5sum:   para.Values["MD5sum"],
+			Control:  text,
+			Values:   para.Values,
+		})
+		return nil
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimRight(line, "\r") == "" {
+			if err = flush(); err != nil {
+				return
+			}
+			continue
+		}
+		lines = append(lines, line)
+	}
+	err = flush()
+	return
+}
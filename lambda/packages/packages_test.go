@@ -0,0 +1,103 @@
+package packages
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	first := "Package: mkr\nVersion: 0.60.0-1.v2\nDescription: mackerel.io api client tool\n mkr is a command-line tool.\nFilename: pool/contrib/m/mkr/mkr_0.60.0-1.v2_amd64.deb\nSize: 100\nMD5sum: 4ca5b53feff0bcb5856d6da3144e397d\n"
+	second := "Package: mkr\nVersion: 0.59.2-1.v2\nFilename: pool/contrib/m/mkr/mkr_0.59.2-1.v2_amd64.deb\nSize: 200\n"
+
+	entries, err := Parse([]byte(first + "\r\n" + second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 2 {
+		t.Fatalf("entries: %d", len(entries))
+	}
+
+	if entries[0].Control != first || entries[1].Control != second {
+		t.Fatalf("control does not match: %q", entries)
+	}
+	if entries[0].Filename != "pool/contrib/m/mkr/mkr_0.60.0-1.v2_amd64.deb" || entries[0].Size != 100 {
+		t.Fatalf("unexpected entry: %+v", entries[0])
+	}
+	if entries[0].MD5sum != "4ca5b53feff0bcb5856d6da3144e397d" {
+		t.Fatalf("unexpected md5sum: %s", entries[0].MD5sum)
+	}
+	if entries[1].Size != 200 {
+		t.Fatalf("unexpected entry: %+v", entries[1])
+	}
+
+	entries, err = Parse(nil)
+	if err != nil || len(entries) != 0 {
+		t.Fatal(entries, err)
+	}
+}
+
+func TestDigest(t *testing.T) {
+	d, err := Sum(strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Size != 5 || d.SHA256 != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+		t.Fatalf("unexpected digest: %+v", d)
+	}
+
+	cached, ok := DigestFromMetadata(5, d.Metadata())
+	if !ok || cached != d {
+		t.Fatalf("unexpected digest: %+v", cached)
+	}
+	if _, ok := DigestFromMetadata(6, d.Metadata()); ok {
+		t.Fatal("digest of another size")
+	}
+	if _, ok := DigestFromMetadata(5, nil); ok {
+		t.Fatal("digest without metadata")
+	}
+
+	if err := d.Verify("LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ="); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Verify("47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="); err == nil {
+		t.Fatal("checksum mismatch is not detected")
+	}
+	if err := d.Verify("47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=-2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Load(strings.NewReader("hello"), "main", "hello.deb"); !errors.Is(err, ErrInvalid) {
+		t.Fatal("not a package is loaded", err)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	entries, err := Parse([]byte("Package: mkr\nVersion: 0.60.0-1.v2\nArchitecture: amd64\nSection: utils\nFilename: pool/contrib/m/mkr/mkr_0.60.0-1.v2_amd64.deb\nSize: 100\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := entries[0]
+
+	for _, tt := range []struct {
+		filter Filter
+		match  bool
+	}{
+		{Filter{}, true},
+		{Filter{Package: "mkr"}, true},
+		{Filter{Package: "mkr", Version: "0.60.*", Architecture: "amd64"}, true},
+		{Filter{Package: "mkr", Version: "0.59.*"}, false},
+		{Filter{Architecture: "arm64"}, false},
+		{Filter{Fields: map[string]string{"Section": "utils"}}, true},
+		{Filter{Fields: map[string]string{"Section": "net"}}, false},
+	} {
+		if got := tt.filter.Match(entry); got != tt.match {
+			t.Errorf("%+v: got %v", tt.filter, got)
+		}
+	}
+
+	if entry.Key() != "mkr 0.60.0-1.v2 amd64" {
+		t.Fatalf("unexpected key: %s", entry.Key())
+	}
+}
@@ -0,0 +1,216 @@
+package publish
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/yseto/apt-s3/lambda/config"
+	"github.com/yseto/apt-s3/lambda/lock"
+	"github.com/yseto/apt-s3/lambda/storage"
+
+	gcs "cloud.google.com/go/storage"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	awsS3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// clientConfig returns cfg with the region, the role, the retries and the
+// logging of c.
+func clientConfig(cfg aws.Config, c config.S3Client) (aws.Config, error) {
+	cfg = cfg.Copy()
+	if c.Region != "" {
+		cfg.Region = c.Region
+	}
+	if c.RoleARN != "" {
+		cfg.Credentials = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), c.RoleARN))
+	}
+
+	if c.RetryMode != "" {
+		mode, err := aws.ParseRetryMode(c.RetryMode)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.RetryMode = mode
+	}
+	if c.MaxAttempts != 0 {
+		cfg.RetryMaxAttempts = c.MaxAttempts
+	}
+	if len(c.LogMode) > 0 {
+		mode, err := clientLogMode(c.LogMode)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.ClientLogMode = mode
+	}
+	return cfg, nil
+}
+
+// newS3Client returns the client of c, with cfg for the fields not set.
+func newS3Client(cfg aws.Config, c config.S3Client) (*awsS3.Client, error) {
+	cfg, err := clientConfig(cfg, c)
+	if err != nil {
+		return nil, err
+	}
+
+	return awsS3.NewFromConfig(cfg, func(o *awsS3.Options) {
+		o.UsePathStyle = c.PathStyle == nil || *c.PathStyle
+		if c.Endpoint != "" {
+			o.BaseEndpoint = aws.String(c.Endpoint)
+		}
+	}), nil
+}
+
+// newDynamoDBClient returns the client of the lock table, with the settings
+// of c as the S3 client of the lockfile has.
+func newDynamoDBClient(cfg aws.Config, c config.S3Client) (*dynamodb.Client, error) {
+	cfg, err := clientConfig(cfg, c)
+	if err != nil {
+		return nil, err
+	}
+
+	return dynamodb.NewFromConfig(cfg, func(o *dynamodb.Options) {
+		if c.Endpoint != "" {
+			o.BaseEndpoint = aws.String(c.Endpoint)
+		}
+	}), nil
+}
+
+var clientLogModes = map[string]aws.ClientLogMode{
+	"signing":            aws.LogSigning,
+	"retries":            aws.LogRetries,
+	"request":            aws.LogRequest,
+	"request_with_body":  aws.LogRequestWithBody,
+	"response":           aws.LogResponse,
+	"response_with_body": aws.LogResponseWithBody,
+}
+
+func clientLogMode(names []string) (mode aws.ClientLogMode, err error) {
+	for _, name := range names {
+		m, ok := clientLogModes[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return 0, fmt.Errorf("unknown log mode: %s", name)
+		}
+		mode |= m
+	}
+	return
+}
+
+// s3Clients are the clients of the buckets uploaded packages are in, and of
+// the repository.
+type s3Clients struct {
+	source, repository *awsS3.Client
+}
+
+// newResolver creates the clients of the storages which are configured.
+func newResolver(ctx context.Context, s3Client *awsS3.Client, aptConfig config.Config) (*storage.Resolver, error) {
+	resolver := &storage.Resolver{
+		S3:           s3Client,
+		ChecksumMode: aptConfig.UseS3Checksum,
+		Policy:       aptConfig.Policy(),
+	}
+
+	uses := func(name, scheme string) bool {
+		return aptConfig.Storage == name ||
+			strings.HasPrefix(aptConfig.PrivateKeyS3Url, scheme+"://") ||
+			strings.HasPrefix(aptConfig.LockKeyS3Url, scheme+"://")
+	}
+
+	if uses("gcs", "gs") {
+		// STORAGE_EMULATOR_HOST points the client to fake-gcs-server.
+		client, err := gcs.NewClient(ctx)
+		if err != nil {
+			return nil, err
+		}
+		resolver.GCS = client
+	}
+
+	if uses("azure", "az") {
+		client, err := azblob.NewClientFromConnectionString(aptConfig.AzureConnectionString, nil)
+		if err != nil {
+			return nil, err
+		}
+		resolver.Azure = client
+	}
+
+	return resolver, nil
+}
+
+// newStorage returns the storage of the repository, and of the buckets
+// uploaded packages are in.
+func newStorage(aptConfig config.Config, resolver *storage.Resolver, clients s3Clients) (storage.Impl, func(bucket string) storage.Impl, error) {
+	var scheme string
+	switch aptConfig.Storage {
+	case "s3":
+		// the packages are copied by the client of the repository, which needs
+		// to read the source bucket.
+		fs := &storage.S3{
+			BucketName:    aptConfig.DestS3Bucket,
+			S3Client:      clients.repository,
+			Policy:        resolver.Policy,
+			CopyThreshold: aptConfig.CopyThreshold,
+			CopyPartSize:  aptConfig.CopyPartSize,
+		}
+		return fs, func(bucket string) storage.Impl {
+			return &storage.S3{
+				BucketName:   bucket,
+				S3Client:     clients.source,
+				ChecksumMode: aptConfig.UseS3Checksum,
+			}
+		}, nil
+	case "gcs":
+		scheme = "gs"
+	case "azure":
+		scheme = "az"
+	case "local":
+		// the bucket of an event is a directory.
+		return &storage.Local{Dir: aptConfig.StorageDir}, func(bucket string) storage.Impl {
+			return &storage.Local{Dir: bucket}
+		}, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown storage: %s", aptConfig.Storage)
+	}
+
+	fs, err := resolver.Bucket(scheme, aptConfig.DestS3Bucket)
+	if err != nil {
+		return nil, nil, err
+	}
+	return fs, func(bucket string) storage.Impl {
+		// the client of the scheme exists, as fs is created.
+		source, _ := resolver.Bucket(scheme, bucket)
+		return source
+	}, nil
+}
+
+// newLocker returns the lock of name, which is empty for the whole repository.
+func newLocker(cfg aws.Config, resolver *storage.Resolver, aptConfig config.Config, owner lock.Owner, name string) (lock.Locker, error) {
+	switch aptConfig.LockBackend {
+	case "s3":
+		lockResolver := *resolver
+		lockResolver.Policy = aptConfig.LockPolicy()
+		fs, key, err := lockResolver.Parse(aptConfig.LockKeyS3Url)
+		if err != nil {
+			return nil, err
+		}
+		if name != "" {
+			// the lock of a component is not under the one of its
+			// distribution, which is a directory on file://.
+			key = path.Join(key, url.PathEscape(name))
+		}
+		return lock.New(fs, key, aptConfig.LockLease, owner), nil
+	case "dynamodb":
+		// the table is in the account and the region of the config bucket.
+		client, err := newDynamoDBClient(cfg, aptConfig.ConfigS3.Or(aptConfig.S3))
+		if err != nil {
+			return nil, err
+		}
+		// the repository bucket is what the lock protects.
+		return lock.NewDynamoDB(client, aptConfig.LockTable, path.Join(aptConfig.DestS3Bucket, name), aptConfig.LockLease, owner), nil
+	}
+	return nil, fmt.Errorf("unknown lock backend: %s", aptConfig.LockBackend)
+}
@@ -0,0 +1,848 @@
+package publish
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yseto/apt-s3/lambda/config"
+	"github.com/yseto/apt-s3/lambda/packages"
+	"github.com/yseto/apt-s3/lambda/release"
+	"github.com/yseto/apt-s3/lambda/sign"
+	"github.com/yseto/apt-s3/lambda/storage"
+
+	"github.com/ProtonMail/gopenpgp/v3/crypto"
+)
+
+// taskOfFile adds the package of source to the pool and the index. The
+// package is uploaded instead of copied when upload, as it is in another
+// storage.
+func taskOfFile(ctx context.Context, source storage.Impl, fs storage.Impl, aptConfig config.Config, src storage.Source, upload bool) error {
+	in, err := source.OpenFile(ctx, src.Key)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	body, err := storage.Body(in)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	object := in.Object()
+	src.ChecksumSHA256 = object.ChecksumSHA256
+	src.Object = &object
+	process, err := processFile(ctx, aptConfig, fs, in, body, src, upload)
+	if err != nil {
+		return err
+	}
+
+	return processPackages(ctx, aptConfig, fs, process, false)
+}
+
+type packagesLoad struct {
+	ControlWithStat, CPU string
+}
+
+// processFile adds the package to the pool, and returns its entry. A pool
+// file which exists, as the pool is shared by the distributions, is kept and
+// its entry is read from it.
+func processFile(ctx context.Context, aptConfig config.Config, fs storage.Impl, in storage.File, body io.Reader, source storage.Source, upload bool) (p packagesLoad, err error) {
+	r, err := packages.LoadAt(in, body, aptConfig.Components, filepath.Base(source.Key))
+	if err != nil {
+		return
+	}
+
+	if err = r.Digest.Verify(source.ChecksumSHA256); err != nil {
+		err = fmt.Errorf("%s: %w", source.Key, err)
+		return
+	}
+
+	// copy deb package
+	destPath := filepath.Join(aptConfig.BaseDir, r.DestPath)
+	exist, err := fs.ExistFile(ctx, destPath)
+	if err != nil {
+		return
+	}
+
+	// the pool is shared by distributions, which may be processed concurrently.
+	// the digest is kept in the object metadata, not to rehash the package later.
+	if !exist {
+		if upload {
+			err = uploadFile(ctx, fs, destPath, in, r.Digest.Metadata())
+		} else {
+			err = fs.CopyFileIfAbsent(ctx, destPath, source, r.Digest.Metadata())
+		}
+		if errors.Is(err, storage.ErrExist) {
+			exist = true
+			err = nil
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	object, err := fs.StatFile(ctx, destPath)
+	if err != nil {
+		return
+	}
+
+	if exist {
+		fmt.Printf("duplicated file: %s\n", source.Key)
+		var sidecar bool
+		sidecar, err = fs.ExistFile(ctx, packages.MetadataPath(destPath))
+		if err != nil {
+			return
+		}
+		r, err = readPackage(ctx, fs, object, map[string]bool{packages.MetadataPath(destPath): sidecar})
+	} else {
+		err = writeMetadata(ctx, fs, object, r)
+	}
+	if err != nil {
+		return
+	}
+
+	// set property
+	p.CPU = r.CPU
+	p.ControlWithStat = r.ControlWithStat
+
+	return
+}
+
+// uploadFile writes the file in to name, unless it exists.
+func uploadFile(ctx context.Context, fs storage.Impl, name string, in storage.File, metadata map[string]string) error {
+	b, err := io.ReadAll(io.NewSectionReader(in, 0, in.Size()))
+	if err != nil {
+		return err
+	}
+
+	_, err = fs.WriteFileIf(ctx, name, b, metadata, storage.Condition{IfNoneMatch: true})
+	if storage.IsConditionFailed(err) {
+		return storage.ErrExist
+	}
+	return err
+}
+
+func writeMetadata(ctx context.Context, fs storage.Impl, object storage.Object, r packages.Package) error {
+	b, err := json.Marshal(packages.Metadata{
+		ETag:            object.ETag,
+		CPU:             r.CPU,
+		ControlWithStat: r.ControlWithStat,
+	})
+	if err != nil {
+		return err
+	}
+
+	return fs.WriteFile(ctx, packages.MetadataPath(object.Key), b, nil)
+}
+
+// readPackage returns the metadata of a pool file from its sidecar, and falls
+// back to downloading the package when the sidecar is missing or stale.
+func readPackage(ctx context.Context, fs storage.Impl, object storage.Object, sidecars map[string]bool) (r packages.Package, err error) {
+	metadataPath := packages.MetadataPath(object.Key)
+	if sidecars[metadataPath] {
+		var b []byte
+		b, err = fs.ReadFile(ctx, metadataPath)
+		if err != nil {
+			return
+		}
+
+		var m packages.Metadata
+		if errU := json.Unmarshal(b, &m); errU != nil {
+			fmt.Printf("broken metadata: %s: %s\n", metadataPath, errU)
+		} else if m.ETag == object.ETag {
+			r.CPU = m.CPU
+			r.ControlWithStat = m.ControlWithStat
+			return
+		}
+	}
+
+	components, _ := poolComponents(object.Key)
+	r, err = loadPackage(ctx, fs, object.Key, components)
+	if err != nil {
+		return
+	}
+
+	err = writeMetadata(ctx, fs, object, r)
+	return
+}
+
+// readPackages runs readPackage with a bounded number of workers, and returns
+// the results in the same order as objects.
+func readPackages(ctx context.Context, fs storage.Impl, objects []storage.Object, sidecars map[string]bool, concurrency int) ([]packages.Package, error) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	var (
+		results = make([]packages.Package, len(objects))
+		indexes = make(chan int)
+		wg      sync.WaitGroup
+	)
+
+	for range min(max(concurrency, 1), len(objects)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				r, err := readPackage(ctx, fs, objects[i], sidecars)
+				if err != nil {
+					cancel(fmt.Errorf("%s: %w", objects[i].Key, err))
+					return
+				}
+				results[i] = r
+			}
+		}()
+	}
+
+send:
+	for i := range objects {
+		select {
+		case indexes <- i:
+		case <-ctx.Done():
+			break send
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	if err := context.Cause(ctx); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func findSidecars(ctx context.Context, fs storage.Impl, root string) (map[string]bool, error) {
+	list, err := fs.FindMetadata(ctx, root)
+	if err != nil {
+		return nil, err
+	}
+
+	var sidecars = make(map[string]bool, len(list))
+	for _, key := range list {
+		sidecars[key] = true
+	}
+	return sidecars, nil
+}
+
+// generate `Packages`
+func processPackages(ctx context.Context, aptConfig config.Config, fs storage.Impl, p packagesLoad, overwrite bool) (err error) {
+	// dists/$DIST/$COMP/binary-$ARCH/Packages
+	packagePath := filepath.Join(aptConfig.DirName(), fmt.Sprintf("binary-%s", p.CPU), "Packages")
+
+	// Packages is written only if it is not changed since it was read, by a
+	// writer which bypassed or lost the lock.
+	data := []byte(p.ControlWithStat)
+	cond := storage.Condition{IfNoneMatch: true}
+
+	b, object, err := fs.GetFile(ctx, packagePath)
+	switch {
+	case storage.IsNotExist(err):
+	case err != nil:
+		return
+	default:
+		cond = storage.Condition{IfMatch: object.ETag}
+		// Packages is empty when every package is removed.
+		if overwrite || len(b) == 0 {
+			break
+		}
+		if indexed(b, p.ControlWithStat) {
+			fmt.Printf("already indexed in %s\n", packagePath)
+			return nil
+		}
+		data = bytes.Join([][]byte{b, data}, []byte("\r\n"))
+	}
+
+	return writePackages(ctx, fs, packagePath, data, cond)
+}
+
+// indexed reports whether the index has the pool file of control.
+func indexed(index []byte, control string) bool {
+	entries, err := packages.Parse(index)
+	if err != nil {
+		return false
+	}
+	added, err := packages.Parse([]byte(control))
+	if err != nil || len(added) != 1 {
+		return false
+	}
+	return slices.ContainsFunc(entries, func(e packages.Entry) bool {
+		return e.Filename == added[0].Filename
+	})
+}
+
+// writePackages writes `Packages` and `Packages.gz`.
+func writePackages(ctx context.Context, fs storage.Impl, packagePath string, data []byte, cond storage.Condition) (err error) {
+	d, err := packages.Sum(bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+	if _, err = fs.WriteFileIf(ctx, packagePath, data, d.Metadata(), cond); err != nil {
+		return
+	}
+
+	buf := bytes.NewBuffer([]byte{})
+	gw := gzip.NewWriter(buf)
+	gw.Write(data)
+	err = gw.Close()
+	if err != nil {
+		return err
+	}
+
+	return packages.WriteIndex(ctx, fs, packagePath+".gz", buf.Bytes())
+}
+
+// promote copies the entries matching filters from the indexes of the
+// distribution from to the configured one. The pool files are shared.
+func promote(ctx context.Context, fs storage.Impl, aptConfig config.Config, from string, filters []packages.Filter) error {
+	if from == "" || from == aptConfig.Distribution {
+		return fmt.Errorf("invalid distribution to promote from: %q", from)
+	}
+	if len(filters) == 0 {
+		return errors.New("no packages to promote")
+	}
+
+	fromDirName := filepath.Join(aptConfig.BaseDir, "dists", from)
+
+	filePaths, err := fs.FindPackages(ctx, aptConfig.BaseDir)
+	if err != nil {
+		return err
+	}
+
+	var promoted int
+	for _, filePath := range filePaths {
+		path, err := filepath.Rel(fromDirName, filePath)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(path, "..") || filepath.Base(path) != "Packages" {
+			continue
+		}
+
+		b, err := fs.ReadFile(ctx, filePath)
+		if err != nil {
+			return err
+		}
+		entries, err := packages.Parse(b)
+		if err != nil {
+			return fmt.Errorf("%s: %w", filePath, err)
+		}
+
+		entries = slices.DeleteFunc(entries, func(e packages.Entry) bool {
+			return !slices.ContainsFunc(filters, func(f packages.Filter) bool {
+				return f.Match(e)
+			})
+		})
+		if len(entries) == 0 {
+			continue
+		}
+
+		packagePath := filepath.Join(aptConfig.DistributionDirName(), path)
+
+		// the promoted entries replace the same package in the target.
+		merged := make(map[string]packages.Entry)
+		cond := storage.Condition{IfNoneMatch: true}
+		b, object, err := fs.GetFile(ctx, packagePath)
+		if err != nil && !storage.IsNotExist(err) {
+			return err
+		}
+		if err == nil {
+			cond = storage.Condition{IfMatch: object.ETag}
+			current, err := packages.Parse(b)
+			if err != nil {
+				return fmt.Errorf("%s: %w", packagePath, err)
+			}
+			for _, entry := range current {
+				merged[entry.Key()] = entry
+			}
+		}
+		for _, entry := range entries {
+			fmt.Printf("promote %s from %s to %s\n", entry.Filename, from, aptConfig.Distribution)
+			merged[entry.Key()] = entry
+			promoted++
+		}
+
+		sorted := slices.SortedFunc(maps.Values(merged), func(a, b packages.Entry) int {
+			return strings.Compare(a.Filename, b.Filename)
+		})
+		contents := make([]string, len(sorted))
+		for i := range sorted {
+			contents[i] = sorted[i].Control
+		}
+
+		if err := writePackages(ctx, fs, packagePath, []byte(strings.Join(contents, "\r\n")), cond); err != nil {
+			return err
+		}
+	}
+
+	if promoted == 0 {
+		return fmt.Errorf("no packages in %s match", from)
+	}
+	return nil
+}
+
+// generate `Release` from the `Packages` of every component in the distribution.
+func processRelease(ctx context.Context, aptConfig config.Config, fs storage.Impl) (err error) {
+	re := regexp.MustCompile("^(.*)/binary-(.*)/Packages.*")
+
+	releasePath := filepath.Join(aptConfig.DistributionDirName(), "Release")
+	cond := storage.Condition{IfNoneMatch: true}
+	object, err := fs.StatFile(ctx, releasePath)
+	switch {
+	case storage.IsNotExist(err):
+	case err != nil:
+		return err
+	default:
+		cond = storage.Condition{IfMatch: object.ETag}
+	}
+
+	filePaths, err := fs.FindPackages(ctx, aptConfig.BaseDir)
+	if err != nil {
+		return err
+	}
+
+	var md5Sum, sha1Sum, sha256Sum []release.Hash
+
+	var (
+		archs      = make(map[string]bool, 0)
+		components = map[string]bool{aptConfig.Components: true}
+	)
+
+	for i := range filePaths {
+		path, err := filepath.Rel(aptConfig.DistributionDirName(), filePaths[i])
+		if err != nil {
+			return err
+		}
+
+		// another distribution.
+		if strings.HasPrefix(path, "..") {
+			continue
+		}
+
+		if res := re.FindStringSubmatch(path); len(res) == 3 {
+			components[res[1]] = true
+			archs[res[2]] = true
+		}
+
+		d, err := indexDigest(ctx, fs, filePaths[i])
+		if err != nil {
+			return err
+		}
+
+		md5Sum = append(md5Sum, release.Hash{
+			Hash:     d.MD5,
+			Size:     d.Size,
+			Filename: path,
+		})
+		sha1Sum = append(sha1Sum, release.Hash{
+			Hash:     d.SHA1,
+			Size:     d.Size,
+			Filename: path,
+		})
+		sha256Sum = append(sha256Sum, release.Hash{
+			Hash:     d.SHA256,
+			Size:     d.Size,
+			Filename: path,
+		})
+	}
+
+	rel, err := release.Generate(release.Release{
+		Origin:        aptConfig.Origin,
+		Label:         aptConfig.Label,
+		Suite:         aptConfig.Suite,
+		CodeName:      aptConfig.CodeName,
+		Date:          time.Now().Format(time.RFC1123),
+		Architectures: slices.Sorted(maps.Keys(archs)),
+		Components:    strings.Join(slices.Sorted(maps.Keys(components)), " "),
+		Description:   aptConfig.Description,
+		AcquireByHash: true,
+		MD5Sum:        md5Sum,
+		SHA1:          sha1Sum,
+		SHA256:        sha256Sum,
+	})
+	if err != nil {
+		return err
+	}
+
+	// Release is replaced only if it is not changed since the indexes were
+	// read.
+	_, err = fs.WriteFileIf(ctx, releasePath, []byte(rel), nil, cond)
+	return err
+}
+
+// publish signs the staged `Release`, adds the by-hash copies of the index
+// files, and writes them in an order which keeps the repository consistent for
+// the clients: by-hash copies, indexes, `Release`, then `InRelease` last.
+func publish(ctx context.Context, aptConfig config.Config, stage *storage.Stage, privKey *crypto.Key) (err error) {
+	distributionDirName := aptConfig.DistributionDirName()
+
+	rel, err := stage.ReadFile(ctx, filepath.Join(distributionDirName, "Release"))
+	if err != nil {
+		stage.Discard()
+		return
+	}
+
+	inRelease, releaseGPG, err := sign.Sign(rel, privKey)
+	if err != nil {
+		// nothing is published.
+		stage.Discard()
+		return
+	}
+
+	filePaths, err := stage.FindPackages(ctx, aptConfig.BaseDir)
+	if err != nil {
+		return
+	}
+
+	for _, name := range filePaths {
+		if !strings.HasPrefix(name, distributionDirName+"/") {
+			continue
+		}
+
+		var d packages.Digest
+		d, err = indexDigest(ctx, stage, name)
+		if err != nil {
+			return
+		}
+
+		byHash := filepath.Join(filepath.Dir(name), "by-hash", "SHA256", d.SHA256)
+		var exist bool
+		if exist, err = stage.ExistFile(ctx, byHash); err != nil {
+			return
+		}
+		if exist {
+			continue
+		}
+
+		var b []byte
+		b, err = stage.ReadFile(ctx, name)
+		if err != nil {
+			return
+		}
+		if err = stage.WriteFile(ctx, byHash, b, d.Metadata()); err != nil {
+			return
+		}
+	}
+
+	if err = stage.WriteFile(ctx, filepath.Join(distributionDirName, "Release.gpg"), releaseGPG, nil); err != nil {
+		return
+	}
+	if err = stage.WriteFile(ctx, filepath.Join(distributionDirName, "InRelease"), inRelease, nil); err != nil {
+		return
+	}
+
+	return stage.Commit(ctx, publishRank)
+}
+
+func publishRank(name string) int {
+	switch {
+	case strings.Contains(name, "/by-hash/"):
+		return 0
+	case filepath.Base(name) == "Release":
+		return 2
+	case filepath.Base(name) == "Release.gpg":
+		return 3
+	case filepath.Base(name) == "InRelease":
+		return 4
+	}
+	return 1
+}
+
+// indexDigest returns the digest of an index file from the object metadata,
+// or hashes the file when it has none.
+func indexDigest(ctx context.Context, fs storage.Impl, name string) (packages.Digest, error) {
+	object, err := fs.StatFile(ctx, name)
+	if err != nil {
+		return packages.Digest{}, err
+	}
+	if d, ok := packages.DigestFromMetadata(object.Size, object.Metadata); ok {
+		return d, nil
+	}
+
+	b, err := fs.ReadFile(ctx, name)
+	if err != nil {
+		return packages.Digest{}, err
+	}
+	return packages.Sum(bytes.NewReader(b))
+}
+
+// reGenerate generates the indexes of the component from the pool files which
+// they refer to. The pool is shared by the distributions, and keeps the
+// removed packages, so the pool files no distribution refers to are added only
+// with RepairMissing, as repair does.
+func reGenerate(ctx context.Context, fs storage.Impl, aptConfig config.Config) error {
+	pool, err := componentPool(ctx, fs, aptConfig)
+	if err != nil {
+		return err
+	}
+
+	sidecars, err := findSidecars(ctx, fs, aptConfig.BaseDir)
+	if err != nil {
+		return err
+	}
+
+	indexes, elsewhere, err := readIndexes(ctx, fs, aptConfig)
+	if err != nil {
+		return err
+	}
+	var referred = make(map[string]bool, 0)
+	for _, entries := range indexes {
+		for _, entry := range entries {
+			referred[entry.Filename] = true
+		}
+	}
+
+	var list []storage.Object
+	for _, filename := range slices.Sorted(maps.Keys(pool)) {
+		switch {
+		case referred[filename]:
+		case elsewhere[filename]:
+			// the package of another distribution.
+			continue
+		case !aptConfig.RepairMissing:
+			fmt.Printf("not indexed: %s\n", filename)
+			continue
+		}
+		list = append(list, pool[filename])
+	}
+
+	results, err := readPackages(ctx, fs, list, sidecars, aptConfig.Concurrency)
+	if err != nil {
+		return err
+	}
+
+	var info = make(map[string][]string, 0)
+	for _, r := range results {
+		info[r.CPU] = append(info[r.CPU], r.ControlWithStat)
+	}
+
+	for cpu, contents := range info {
+		control := strings.Join(contents, "\r\n")
+
+		err = processPackages(ctx, aptConfig, fs, packagesLoad{CPU: cpu, ControlWithStat: control}, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// componentPool returns the pool files of the component, by their filenames.
+func componentPool(ctx context.Context, fs storage.Impl, aptConfig config.Config) (map[string]storage.Object, error) {
+	objects, err := fs.ListDeb(ctx, aptConfig.BaseDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var pool = make(map[string]storage.Object, len(objects))
+	for _, object := range objects {
+		if components, ok := poolComponents(object.Key); !ok || components != aptConfig.Components {
+			continue
+		}
+		filename, err := filepath.Rel(aptConfig.BaseDir, object.Key)
+		if err != nil {
+			return nil, err
+		}
+		pool[filename] = object
+	}
+	return pool, nil
+}
+
+// readIndexes returns the entries of the indexes of the component by
+// architecture, and the filenames which the other indexes refer to.
+func readIndexes(ctx context.Context, fs storage.Impl, aptConfig config.Config) (info map[string][]packages.Entry, elsewhere map[string]bool, err error) {
+	filePaths, err := fs.FindPackages(ctx, aptConfig.BaseDir)
+	if err != nil {
+		return
+	}
+
+	info = make(map[string][]packages.Entry, 0)
+	elsewhere = make(map[string]bool, 0)
+	for _, path := range filePaths {
+		if filepath.Base(path) != "Packages" {
+			continue
+		}
+		cpu, ok := strings.CutPrefix(filepath.Base(filepath.Dir(path)), "binary-")
+		if !ok {
+			continue
+		}
+
+		b, err := fs.ReadFile(ctx, path)
+		if err != nil {
+			return nil, nil, err
+		}
+		entries, err := packages.Parse(b)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		if filepath.Dir(filepath.Dir(path)) == aptConfig.DirName() {
+			info[cpu] = entries
+			continue
+		}
+		for _, entry := range entries {
+			elsewhere[entry.Filename] = true
+		}
+	}
+	return
+}
+
+var poolComponentsRe = regexp.MustCompile("(?:^|/)pool/([^/]+)/")
+
+func poolComponents(path string) (string, bool) {
+	res := poolComponentsRe.FindStringSubmatch(path)
+	if len(res) != 2 {
+		return "", false
+	}
+	return res[1], true
+}
+
+func loadPackage(ctx context.Context, fs storage.Impl, key, components string) (r packages.Package, err error) {
+	in, err := fs.OpenFile(ctx, key)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+
+	if d, ok := packages.DigestFromMetadata(in.Size(), in.Object().Metadata); ok {
+		return packages.LoadWithDigest(in, d, components, filepath.Base(key))
+	}
+
+	body, err := storage.Body(in)
+	if err != nil {
+		return
+	}
+	defer body.Close()
+
+	return packages.LoadAt(in, body, components, filepath.Base(key))
+}
+
+// repair compares the pool of the component with the existing `Packages`
+// indexes, and only loads the packages which are missing or mismatched. The
+// pool is shared by the distributions, so the pool files no index refers to
+// are added only with RepairMissing.
+func repair(ctx context.Context, fs storage.Impl, aptConfig config.Config) error {
+	pool, err := componentPool(ctx, fs, aptConfig)
+	if err != nil {
+		return err
+	}
+
+	sidecars, err := findSidecars(ctx, fs, aptConfig.BaseDir)
+	if err != nil {
+		return err
+	}
+
+	info, elsewhere, err := readIndexes(ctx, fs, aptConfig)
+	if err != nil {
+		return err
+	}
+
+	var (
+		referred = make(map[string]bool, 0)
+		checked  []storage.Object
+	)
+	for _, cpu := range slices.Sorted(maps.Keys(info)) {
+		for _, entry := range info[cpu] {
+			if object, ok := pool[entry.Filename]; ok && !referred[entry.Filename] {
+				referred[entry.Filename] = true
+				checked = append(checked, object)
+			}
+		}
+	}
+
+	// the digests of the pool files, from the sidecars.
+	results, err := readPackages(ctx, fs, checked, sidecars, aptConfig.Concurrency)
+	if err != nil {
+		return err
+	}
+	var md5sums = make(map[string]string, len(results))
+	for i, r := range results {
+		entries, err := packages.Parse([]byte(r.ControlWithStat))
+		if err != nil || len(entries) != 1 {
+			return fmt.Errorf("%s: broken control: %v", checked[i].Key, err)
+		}
+		md5sums[checked[i].Key] = entries[0].MD5sum
+	}
+
+	var (
+		indexed = make(map[string]bool, 0)
+		changed bool
+	)
+	for cpu, entries := range info {
+		info[cpu] = []packages.Entry{}
+		for _, entry := range entries {
+			object, ok := pool[entry.Filename]
+			if !ok || object.Size != entry.Size || md5sums[object.Key] != entry.MD5sum || indexed[entry.Filename] {
+				fmt.Printf("remove stale entry: %s\n", entry.Filename)
+				changed = true
+				continue
+			}
+			indexed[entry.Filename] = true
+			info[cpu] = append(info[cpu], entry)
+		}
+	}
+
+	var (
+		missing   []string
+		unindexed []storage.Object
+	)
+	for _, filename := range slices.Sorted(maps.Keys(pool)) {
+		switch {
+		case indexed[filename]:
+		case elsewhere[filename]:
+			// the package of another distribution.
+		case !aptConfig.RepairMissing:
+			fmt.Printf("not indexed: %s\n", filename)
+		default:
+			missing = append(missing, filename)
+			unindexed = append(unindexed, pool[filename])
+		}
+	}
+
+	results, err = readPackages(ctx, fs, unindexed, sidecars, aptConfig.Concurrency)
+	if err != nil {
+		return err
+	}
+
+	for i, r := range results {
+		fmt.Printf("add missing entry: %s\n", missing[i])
+		changed = true
+		info[r.CPU] = append(info[r.CPU], packages.Entry{Filename: missing[i], Control: r.ControlWithStat})
+	}
+
+	if !changed {
+		fmt.Println("repository is consistent")
+		return nil
+	}
+
+	for cpu, entries := range info {
+		slices.SortFunc(entries, func(a, b packages.Entry) int {
+			return strings.Compare(a.Filename, b.Filename)
+		})
+
+		contents := make([]string, len(entries))
+		for i := range entries {
+			contents[i] = entries[i].Control
+		}
+		control := strings.Join(contents, "\r\n")
+
+		err = processPackages(ctx, aptConfig, fs, packagesLoad{CPU: cpu, ControlWithStat: control}, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
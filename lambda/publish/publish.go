@@ -0,0 +1,302 @@
+// Package publish maintains the apt repository in a storage, for the Lambda
+// function and the apt-s3 command.
+package publish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/yseto/apt-s3/lambda/config"
+	"github.com/yseto/apt-s3/lambda/lock"
+	"github.com/yseto/apt-s3/lambda/packages"
+	"github.com/yseto/apt-s3/lambda/sign"
+	"github.com/yseto/apt-s3/lambda/snapshot"
+	"github.com/yseto/apt-s3/lambda/storage"
+
+	"github.com/ProtonMail/gopenpgp/v3/crypto"
+	awsConfig "github.com/aws/aws-sdk-go-v2/config"
+)
+
+// Repository is the repository of Config in FS. The indexes are changed
+// holding the lock, and published at once with a signed `Release`.
+type Repository struct {
+	Config config.Config
+	FS     storage.Impl
+	// Source returns the storage of the bucket uploaded packages are in.
+	Source    func(bucket string) storage.Impl
+	NewLocker func(name string) (lock.Locker, error)
+	PrivKey   *crypto.Key
+}
+
+// New returns the repository of aptConfig, with the clients of the storages it
+// uses.
+func New(ctx context.Context, aptConfig config.Config) (*Repository, error) {
+	cfg, err := awsConfig.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// the private key and the lockfile are read with the client of the config
+	// bucket.
+	configS3, err := newS3Client(cfg, aptConfig.ConfigS3.Or(aptConfig.S3))
+	if err != nil {
+		return nil, err
+	}
+	resolver, err := newResolver(ctx, configS3, aptConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	privKey, err := sign.ReadKey(ctx, resolver, aptConfig.PrivateKeyS3Url)
+	if err != nil {
+		return nil, err
+	}
+
+	var clients s3Clients
+	if clients.source, err = newS3Client(cfg, aptConfig.SourceS3.Or(aptConfig.S3)); err != nil {
+		return nil, err
+	}
+	if clients.repository, err = newS3Client(cfg, aptConfig.RepositoryS3.Or(aptConfig.S3)); err != nil {
+		return nil, err
+	}
+
+	fs, source, err := newStorage(aptConfig, resolver, clients)
+	if err != nil {
+		return nil, err
+	}
+
+	owner := lock.DefaultOwner
+	if aptConfig.LockOwner != "" {
+		owner = lock.TokenOwner(aptConfig.LockOwner)
+	}
+
+	return &Repository{
+		Config:  aptConfig,
+		FS:      fs,
+		Source:  source,
+		PrivKey: privKey,
+		NewLocker: func(name string) (lock.Locker, error) {
+			return newLocker(cfg, resolver, aptConfig, owner, name)
+		},
+	}, nil
+}
+
+// Add adds the packages uploaded to the source buckets, copying them into the
+// pool.
+func (r *Repository) Add(ctx context.Context, sources []storage.Source) error {
+	return r.update(ctx, r.Config, func(ctx context.Context, stage *storage.Stage) error {
+		for _, source := range sources {
+			if err := taskOfFile(ctx, r.Source(source.Bucket), stage, r.Config, source, false); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Upload adds the local package files, uploading them into the pool.
+func (r *Repository) Upload(ctx context.Context, names []string) error {
+	return r.update(ctx, r.Config, func(ctx context.Context, stage *storage.Stage) error {
+		for _, name := range names {
+			dir, key := filepath.Split(name)
+			source := &storage.Local{Dir: dir}
+			if err := taskOfFile(ctx, source, stage, r.Config, storage.Source{Bucket: dir, Key: key}, true); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Remove removes the entries matching filters from the indexes of the
+// distribution. The pool files no index refers to are deleted, when the whole
+// repository is locked.
+func (r *Repository) Remove(ctx context.Context, filters []packages.Filter) error {
+	if len(filters) == 0 {
+		return errors.New("no packages to remove")
+	}
+
+	lockName, err := r.Config.LockName()
+	if err != nil {
+		return err
+	}
+
+	return r.locked(ctx, lockName, func(ctx context.Context) error {
+		stage := storage.NewStage(r.FS, r.Config.DistributionDirName())
+		removed, err := remove(ctx, stage, r.Config, filters)
+		if err != nil {
+			return err
+		}
+		if err := r.release(ctx, r.Config, stage); err != nil {
+			return err
+		}
+
+		if r.Config.LockScope != config.LockScopeRepository {
+			// another distribution may add the same files meanwhile.
+			fmt.Println("pool files are kept, as the repository is not locked")
+			return nil
+		}
+		return prune(ctx, r.FS, r.Config, removed)
+	})
+}
+
+// Regenerate generates the indexes from the packages in the pool.
+func (r *Repository) Regenerate(ctx context.Context) error {
+	return r.update(ctx, r.Config, func(ctx context.Context, stage *storage.Stage) error {
+		return reGenerate(ctx, stage, r.Config)
+	})
+}
+
+// Repair fixes the entries of the indexes which do not match the pool.
+func (r *Repository) Repair(ctx context.Context) error {
+	return r.update(ctx, r.Config, func(ctx context.Context, stage *storage.Stage) error {
+		return repair(ctx, stage, r.Config)
+	})
+}
+
+// Promote copies the entries matching filters from the distribution from to
+// the distribution to, the configured one when empty.
+func (r *Repository) Promote(ctx context.Context, from, to string, filters []packages.Filter) error {
+	aptConfig := r.distribution(to)
+	return r.update(ctx, aptConfig, func(ctx context.Context, stage *storage.Stage) error {
+		return promote(ctx, stage, aptConfig, from, filters)
+	})
+}
+
+// Restore publishes the snapshot name as the distribution to, the configured
+// one when empty.
+func (r *Repository) Restore(ctx context.Context, name, to string) error {
+	aptConfig := r.distribution(to)
+	return r.update(ctx, aptConfig, func(ctx context.Context, stage *storage.Stage) error {
+		m, err := snapshot.Load(ctx, r.FS, aptConfig.BaseDir, name)
+		if err != nil {
+			return err
+		}
+		return snapshot.Restore(ctx, stage, aptConfig.BaseDir, m, aptConfig.Distribution)
+	})
+}
+
+// Snapshot creates the snapshot name of the distribution. The lock of the
+// distribution is held, as the indexes of every component are copied.
+func (r *Repository) Snapshot(ctx context.Context, name string) (m snapshot.Manifest, err error) {
+	if _, err = r.Config.LockName(); err != nil {
+		return
+	}
+
+	err = r.locked(ctx, r.releaseLockName(r.Config), func(ctx context.Context) (err error) {
+		m, err = snapshot.Create(ctx, r.FS, r.Config.BaseDir, r.Config.Distribution, name)
+		if err != nil {
+			return
+		}
+		fmt.Printf("snapshot %s of %s is created\n", m.Name, m.Distribution)
+		return
+	})
+	return
+}
+
+// Snapshots returns the snapshots of the repository.
+func (r *Repository) Snapshots(ctx context.Context) (list []snapshot.Manifest, err error) {
+	lockName, err := r.Config.LockName()
+	if err != nil {
+		return
+	}
+
+	err = r.locked(ctx, lockName, func(ctx context.Context) (err error) {
+		list, err = snapshot.List(ctx, r.FS, r.Config.BaseDir)
+		return
+	})
+	return
+}
+
+// Sign signs the `Release` of the distribution again.
+func (r *Repository) Sign(ctx context.Context) error {
+	return r.locked(ctx, r.releaseLockName(r.Config), func(ctx context.Context) error {
+		return sign.Do(ctx, r.FS, r.Config, r.PrivKey)
+	})
+}
+
+// distribution returns the config of the distribution name, the configured
+// one when empty.
+func (r *Repository) distribution(name string) config.Config {
+	aptConfig := r.Config
+	if name != "" && name != aptConfig.Distribution {
+		aptConfig.Distribution = name
+		aptConfig.CodeName = name
+		aptConfig.Suite = name
+	}
+	return aptConfig
+}
+
+// update runs fn on the staged indexes holding the lock of aptConfig, and
+// publishes them.
+func (r *Repository) update(ctx context.Context, aptConfig config.Config, fn func(ctx context.Context, stage *storage.Stage) error) error {
+	lockName, err := aptConfig.LockName()
+	if err != nil {
+		return err
+	}
+
+	return r.locked(ctx, lockName, func(ctx context.Context) error {
+		// index files are published at once, after they are all generated.
+		stage := storage.NewStage(r.FS, aptConfig.DistributionDirName())
+		if err := fn(ctx, stage); err != nil {
+			return err
+		}
+		return r.release(ctx, aptConfig, stage)
+	})
+}
+
+// release generates `Release` of the staged indexes, and publishes them.
+func (r *Repository) release(ctx context.Context, aptConfig config.Config, stage *storage.Stage) error {
+	commit := func(ctx context.Context) error {
+		if err := processRelease(ctx, aptConfig, stage); err != nil {
+			return err
+		}
+		return publish(ctx, aptConfig, stage, r.PrivKey)
+	}
+
+	if aptConfig.LockScope != config.LockScopeComponent {
+		return commit(ctx)
+	}
+	return r.locked(ctx, r.releaseLockName(aptConfig), commit)
+}
+
+// releaseLockName returns the name of the lock of `Release`, which is shared
+// by the components of the distribution.
+func (r *Repository) releaseLockName(aptConfig config.Config) string {
+	if aptConfig.LockScope == config.LockScopeComponent {
+		return aptConfig.Distribution
+	}
+	// the scope is valid, as it is checked on locking the indexes.
+	name, _ := aptConfig.LockName()
+	return name
+}
+
+// locked runs fn holding the lock name. The context of fn is canceled when
+// the lock is lost.
+func (r *Repository) locked(ctx context.Context, name string, fn func(ctx context.Context) error) (err error) {
+	lockHandler, err := r.NewLocker(name)
+	if err != nil {
+		return
+	}
+
+	if err = lockHandler.GetLock(ctx); err != nil {
+		return
+	}
+	defer func() {
+		errL := lockHandler.UnLock(ctx)
+		if errL != nil {
+			err = errL
+		}
+	}()
+
+	workCtx := lockHandler.KeepAlive(ctx)
+	defer func() {
+		if cause := context.Cause(workCtx); err != nil && cause != nil {
+			err = cause
+		}
+	}()
+
+	return fn(workCtx)
+}
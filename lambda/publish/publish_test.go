@@ -0,0 +1,698 @@
+package publish
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/gopenpgp/v3/crypto"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/yseto/apt-s3/lambda/config"
+	"github.com/yseto/apt-s3/lambda/lock"
+	"github.com/yseto/apt-s3/lambda/packages"
+	"github.com/yseto/apt-s3/lambda/storage"
+)
+
+// buildDeb returns a minimal package, an ar(1) archive of debian-binary,
+// control.tar.gz and data.tar.gz.
+func buildDeb(t *testing.T, name, version, arch string) []byte {
+	t.Helper()
+
+	control := fmt.Sprintf("Package: %s\nVersion: %s\nArchitecture: %s\nMaintainer: tester <tester@example.com>\nDescription: test package\n", name, version, arch)
+
+	tarGz := func(files map[string]string) []byte {
+		buf := new(bytes.Buffer)
+		gw := gzip.NewWriter(buf)
+		tw := tar.NewWriter(gw)
+		for name, content := range files {
+			if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(content))}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tw.Write([]byte(content)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := gw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	buf := bytes.NewBufferString("!<arch>\n")
+	for _, member := range []struct {
+		name string
+		data []byte
+	}{
+		{"debian-binary", []byte("2.0\n")},
+		{"control.tar.gz", tarGz(map[string]string{"./control": control})},
+		{"data.tar.gz", tarGz(nil)},
+	} {
+		fmt.Fprintf(buf, "%-16s%-12d%-6d%-6d%-8s%-10d`\n", member.name, 0, 0, 0, "100644", len(member.data))
+		buf.Write(member.data)
+		if len(member.data)%2 == 1 {
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Bytes()
+}
+
+type nopLocker struct{}
+
+func (nopLocker) GetLock(context.Context) error                 { return nil }
+func (nopLocker) KeepAlive(ctx context.Context) context.Context { return ctx }
+func (nopLocker) UnLock(context.Context) error                  { return nil }
+func newNopLocker(string) (lock.Locker, error)                  { return nopLocker{}, nil }
+
+func uploaded(bucket, key string) []storage.Source {
+	return []storage.Source{{Bucket: bucket, Key: key}}
+}
+
+func newTestRepository(t *testing.T) (*Repository, *storage.Memory, *storage.Memory) {
+	t.Helper()
+
+	privKey, err := crypto.PGP().KeyGeneration().AddUserId("tester", "tester@example.com").New().GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aptConfig := config.Config{
+		BaseDir:      "debian",
+		Distribution: "stable",
+		Origin:       "tester",
+		Label:        "tester",
+		Suite:        "stable",
+		CodeName:     "stable",
+		Components:   "main",
+		Description:  "test repository",
+		LockScope:    config.LockScopeRepository,
+		Concurrency:  2,
+
+		ImmutableCacheControl: "max-age=31536000, immutable",
+		IndexCacheControl:     "no-cache",
+	}
+
+	fs := storage.NewMemory()
+	fs.Policy = aptConfig.Policy()
+	incoming := storage.NewMemory()
+	fs.Buckets["incoming"] = incoming
+
+	return &Repository{
+		Config:    aptConfig,
+		FS:        fs,
+		Source:    func(string) storage.Impl { return incoming },
+		NewLocker: newNopLocker,
+		PrivKey:   privKey,
+	}, fs, incoming
+}
+
+func readString(t *testing.T, fs storage.Impl, name string) string {
+	t.Helper()
+	b, err := fs.ReadFile(t.Context(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestPipeline(t *testing.T) {
+	r, fs, incoming := newTestRepository(t)
+	ctx := t.Context()
+
+	newer := buildDeb(t, "mkr", "0.60.0", "amd64")
+	older := buildDeb(t, "mkr", "0.59.2", "amd64")
+	if err := incoming.WriteFile(ctx, "mkr_0.60.0_amd64.deb", newer, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := incoming.WriteFile(ctx, "mkr_0.59.2_amd64.deb", older, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	entry := func(version string, deb []byte) string {
+		d, err := packages.Sum(bytes.NewReader(deb))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprintf("Package: mkr\nVersion: %s\nArchitecture: amd64\nMaintainer: tester <tester@example.com>\nDescription: test package\nFilename: pool/main/m/mkr/mkr_%s_amd64.deb\nSize: %d\nMD5sum: %s\nSHA1: %s\nSHA256: %s\nInstalled-Size: 0\n", version, version, d.Size, d.MD5, d.SHA1, d.SHA256)
+	}
+
+	t.Run("upload", func(t *testing.T) {
+		if err := r.Add(ctx, uploaded("incoming", "mkr_0.60.0_amd64.deb")); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Add(ctx, uploaded("incoming", "mkr_0.59.2_amd64.deb")); err != nil {
+			t.Fatal(err)
+		}
+
+		if b := readString(t, fs, "debian/pool/main/m/mkr/mkr_0.60.0_amd64.deb"); b != string(newer) {
+			t.Fatal("pool file does not match")
+		}
+
+		got := readString(t, fs, "debian/dists/stable/main/binary-amd64/Packages")
+		want := entry("0.60.0", newer) + "\r\n" + entry("0.59.2", older)
+		if got != want {
+			t.Fatalf("Packages:\n%q\nwant:\n%q", got, want)
+		}
+	})
+
+	t.Run("duplicate", func(t *testing.T) {
+		before := readString(t, fs, "debian/dists/stable/main/binary-amd64/Packages")
+		if err := r.Add(ctx, uploaded("incoming", "mkr_0.60.0_amd64.deb")); err != nil {
+			t.Fatal(err)
+		}
+		if after := readString(t, fs, "debian/dists/stable/main/binary-amd64/Packages"); after != before {
+			t.Fatalf("Packages is changed:\n%s", after)
+		}
+	})
+
+	t.Run("release", func(t *testing.T) {
+		rel := readString(t, fs, "debian/dists/stable/Release")
+		for _, line := range []string{
+			"Origin: tester\n",
+			"Codename: stable\n",
+			"Architectures: amd64\n",
+			"Components: main\n",
+			"Acquire-By-Hash: yes\n",
+		} {
+			if !strings.Contains(rel, line) {
+				t.Errorf("Release does not contain %q:\n%s", line, rel)
+			}
+		}
+
+		d, err := packages.Sum(strings.NewReader(readString(t, fs, "debian/dists/stable/main/binary-amd64/Packages")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line := fmt.Sprintf(" %s %d main/binary-amd64/Packages\n", d.SHA256, d.Size); !strings.Contains(rel, line) {
+			t.Errorf("Release does not contain %q:\n%s", line, rel)
+		}
+		if exist, err := fs.ExistFile(ctx, "debian/dists/stable/main/binary-amd64/by-hash/SHA256/"+d.SHA256); err != nil || !exist {
+			t.Error("by-hash file is missing", err)
+		}
+	})
+
+	t.Run("headers", func(t *testing.T) {
+		for name, want := range map[string]storage.Headers{
+			"debian/dists/stable/InRelease":               {ContentType: "text/plain; charset=utf-8", CacheControl: "no-cache"},
+			"debian/pool/main/m/mkr/mkr_0.60.0_amd64.deb": {ContentType: "application/vnd.debian.binary-package", CacheControl: "max-age=31536000, immutable"},
+		} {
+			object, err := fs.StatFile(ctx, name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if object.Headers != want {
+				t.Errorf("%s: %+v", name, object.Headers)
+			}
+		}
+	})
+
+	t.Run("sign", func(t *testing.T) {
+		pgp := crypto.PGP()
+		verifier, err := pgp.Verify().VerificationKey(r.PrivKey).New()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rel := readString(t, fs, "debian/dists/stable/Release")
+
+		result, err := verifier.VerifyCleartext([]byte(readString(t, fs, "debian/dists/stable/InRelease")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := result.SignatureError(); err != nil {
+			t.Fatal(err)
+		}
+		if string(result.Cleartext()) != strings.TrimSuffix(rel, "\n") && string(result.Cleartext()) != rel {
+			t.Fatalf("InRelease does not match Release:\n%s", result.Cleartext())
+		}
+
+		detached, err := verifier.VerifyDetached([]byte(rel), []byte(readString(t, fs, "debian/dists/stable/Release.gpg")), crypto.Armor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := detached.SignatureError(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("snapshot", func(t *testing.T) {
+		before := readString(t, fs, "debian/dists/stable/main/binary-amd64/Packages")
+		if _, err := r.Snapshot(ctx, "first"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.Snapshot(ctx, "first"); err == nil {
+			t.Fatal("snapshot is overwritten")
+		}
+
+		list, err := r.Snapshots(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list) != 1 || list[0].Name != "first" || len(list[0].Pool) != 2 {
+			t.Fatalf("unexpected snapshots: %+v", list)
+		}
+
+		if err := fs.WriteFile(ctx, "debian/dists/stable/main/binary-amd64/Packages", []byte(entry("0.60.0", newer)), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Restore(ctx, "first", ""); err != nil {
+			t.Fatal(err)
+		}
+		if after := readString(t, fs, "debian/dists/stable/main/binary-amd64/Packages"); after != before {
+			t.Fatalf("Packages is not restored:\n%s", after)
+		}
+
+		if err := r.Restore(ctx, "first", "stable-first"); err != nil {
+			t.Fatal(err)
+		}
+		if got := readString(t, fs, "debian/dists/stable-first/main/binary-amd64/Packages"); got != before {
+			t.Fatalf("Packages:\n%s", got)
+		}
+		if rel := readString(t, fs, "debian/dists/stable-first/Release"); !strings.Contains(rel, "Codename: stable-first\n") {
+			t.Fatalf("Release:\n%s", rel)
+		}
+	})
+
+	t.Run("promote", func(t *testing.T) {
+		if err := r.Promote(ctx, "stable", "production", []packages.Filter{{Package: "mkr", Version: "0.60.*"}}); err != nil {
+			t.Fatal(err)
+		}
+		if got := readString(t, fs, "debian/dists/production/main/binary-amd64/Packages"); got != entry("0.60.0", newer) {
+			t.Fatalf("Packages:\n%s", got)
+		}
+		if err := r.Promote(ctx, "stable", "production", []packages.Filter{{Package: "missing"}}); err == nil {
+			t.Fatal("nothing is promoted")
+		}
+	})
+
+	t.Run("regenerate", func(t *testing.T) {
+		// the entries are generated again from the pool files they refer to.
+		stale := "Package: mkr\nFilename: pool/main/m/mkr/mkr_0.60.0_amd64.deb\nSize: 0\n\r\nPackage: mkr\nFilename: pool/main/m/mkr/mkr_0.59.2_amd64.deb\nSize: 0\n"
+		if err := fs.WriteFile(ctx, "debian/dists/stable/main/binary-amd64/Packages", []byte(stale), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Regenerate(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		got := readString(t, fs, "debian/dists/stable/main/binary-amd64/Packages")
+		want := entry("0.59.2", older) + "\r\n" + entry("0.60.0", newer)
+		if got != want {
+			t.Fatalf("Packages:\n%q\nwant:\n%q", got, want)
+		}
+	})
+}
+
+func TestUploadRemove(t *testing.T) {
+	r, fs, _ := newTestRepository(t)
+	ctx := t.Context()
+
+	deb := filepath.Join(t.TempDir(), "mkr_0.60.0_amd64.deb")
+	if err := os.WriteFile(deb, buildDeb(t, "mkr", "0.60.0", "amd64"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Upload(ctx, []string{deb}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Upload(ctx, []string{deb}); err != nil {
+		t.Fatal(err)
+	}
+	list, err := r.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Values["Package"] != "mkr" || list[0].Filename != "pool/main/m/mkr/mkr_0.60.0_amd64.deb" {
+		t.Fatalf("unexpected entries: %+v", list)
+	}
+
+	if err := r.Sign(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Verify(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// the changes keeping the size and the metadata are found.
+	const poolName = "debian/pool/main/m/mkr/mkr_0.60.0_amd64.deb"
+	b, err := fs.ReadFile(ctx, poolName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed := bytes.Clone(b)
+	changed[len(changed)-1] ^= 0xff
+	if err := fs.WriteFile(ctx, poolName, changed, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Verify(ctx); err == nil {
+		t.Fatal("changed pool file is verified")
+	}
+	if err := fs.WriteFile(ctx, poolName, b, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Verify(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	object, err := fs.StatFile(ctx, "debian/dists/stable/main/binary-amd64/Packages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := strings.Replace(readString(t, fs, "debian/dists/stable/main/binary-amd64/Packages"), "Package: mkr", "Package: mkt", 1)
+	if err := fs.WriteFile(ctx, "debian/dists/stable/main/binary-amd64/Packages", []byte(index), object.Metadata); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Verify(ctx); err == nil {
+		t.Fatal("changed Packages is verified")
+	}
+
+	if err := r.Remove(ctx, []packages.Filter{{Package: "missing"}}); err == nil {
+		t.Fatal("nothing is removed")
+	}
+	if err := r.Regenerate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Remove(ctx, []packages.Filter{{Package: "mkr"}}); err != nil {
+		t.Fatal(err)
+	}
+	if list, err := r.List(ctx); err != nil || len(list) != 0 {
+		t.Fatal(list, err)
+	}
+	if exists, err := fs.ExistFile(ctx, "debian/pool/main/m/mkr/mkr_0.60.0_amd64.deb"); err != nil || exists {
+		t.Fatal("pool file is not deleted", err)
+	}
+	if err := r.Verify(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Upload(ctx, []string{deb}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readString(t, fs, "debian/dists/stable/main/binary-amd64/Packages"); !strings.HasPrefix(got, "Package: mkr\n") {
+		t.Fatalf("Packages:\n%q", got)
+	}
+
+	// the pool file of a snapshot is kept.
+	if _, err := r.Snapshot(ctx, "s1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Remove(ctx, []packages.Filter{{Package: "mkr"}}); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := fs.ExistFile(ctx, "debian/pool/main/m/mkr/mkr_0.60.0_amd64.deb"); err != nil || !exists {
+		t.Fatal("pool file of the snapshot is deleted", err)
+	}
+	if err := r.Restore(ctx, "s1", ""); err != nil {
+		t.Fatal(err)
+	}
+	if list, err := r.List(ctx); err != nil || len(list) != 1 {
+		t.Fatal(list, err)
+	}
+}
+
+func TestUploadShared(t *testing.T) {
+	r, _, _ := newTestRepository(t)
+	ctx := t.Context()
+
+	deb := filepath.Join(t.TempDir(), "mkr_0.60.0_amd64.deb")
+	if err := os.WriteFile(deb, buildDeb(t, "mkr", "0.60.0", "amd64"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Upload(ctx, []string{deb}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the pool file exists, and is indexed by testing too.
+	other := *r
+	other.Config = r.distribution("testing")
+	for range 2 {
+		if err := other.Upload(ctx, []string{deb}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, r := range []*Repository{r, &other} {
+		list, err := r.List(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list) != 1 || list[0].Filename != "pool/main/m/mkr/mkr_0.60.0_amd64.deb" {
+			t.Fatalf("%s: unexpected entries: %+v", r.Config.Distribution, list)
+		}
+	}
+}
+
+func TestRepair(t *testing.T) {
+	r, fs, _ := newTestRepository(t)
+	ctx := t.Context()
+
+	deb := filepath.Join(t.TempDir(), "mkr_0.60.0_amd64.deb")
+	if err := os.WriteFile(deb, buildDeb(t, "mkr", "0.60.0", "amd64"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Upload(ctx, []string{deb}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the pool file of stable is not added to testing.
+	other := *r
+	other.Config = r.distribution("testing")
+	other.Config.RepairMissing = true
+	if err := other.Repair(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if list, err := other.List(ctx); err != nil || len(list) != 0 {
+		t.Fatal(list, err)
+	}
+
+	const name = "debian/dists/stable/main/binary-amd64/Packages"
+	want := readString(t, fs, name)
+	md5sum := regexp.MustCompile("(?m)^MD5sum: .*$")
+	if err := fs.WriteFile(ctx, name, []byte(md5sum.ReplaceAllString(want, "MD5sum: 0")), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the mismatched entry is removed, and added back only with RepairMissing.
+	if err := r.Repair(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if list, err := r.List(ctx); err != nil || len(list) != 0 {
+		t.Fatal(list, err)
+	}
+	r.Config.RepairMissing = true
+	if err := r.Repair(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := readString(t, fs, name); got != want {
+		t.Fatalf("Packages:\n%q\nwant:\n%q", got, want)
+	}
+}
+
+func TestRemoveRegenerate(t *testing.T) {
+	r, _, _ := newTestRepository(t)
+	ctx := t.Context()
+	// the pool files are kept on removal.
+	r.Config.LockScope = config.LockScopeDistribution
+
+	dir := t.TempDir()
+	var debs []string
+	for _, name := range []string{"mkr", "mkt", "mackerel-agent"} {
+		deb := filepath.Join(dir, name+"_0.60.0_amd64.deb")
+		if err := os.WriteFile(deb, buildDeb(t, name, "0.60.0", "amd64"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		debs = append(debs, deb)
+	}
+	if err := r.Upload(ctx, debs[:2]); err != nil {
+		t.Fatal(err)
+	}
+	other := *r
+	other.Config = r.distribution("testing")
+	if err := other.Upload(ctx, debs[2:]); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Remove(ctx, []packages.Filter{{Package: "mkt"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// neither the removed package nor the one of testing is indexed.
+	if err := r.Regenerate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	list, err := r.List(ctx)
+	if err != nil || len(list) != 1 || list[0].Values["Package"] != "mkr" {
+		t.Fatal(list, err)
+	}
+
+	// the removed package is added back only on request.
+	r.Config.RepairMissing = true
+	if err := r.Regenerate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if list, err = r.List(ctx); err != nil || len(list) != 2 {
+		t.Fatal(list, err)
+	}
+}
+
+func TestLockComponent(t *testing.T) {
+	r, _, _ := newTestRepository(t)
+	ctx, cancel := context.WithTimeout(t.Context(), 30*time.Second)
+	defer cancel()
+
+	// the lock of the component is held while Release is locked.
+	r.Config.LockScope = config.LockScopeComponent
+	r.Config.LockBackend = "s3"
+	r.Config.LockKeyS3Url = "file://" + filepath.Join(t.TempDir(), "lockfile")
+	r.Config.LockLease = time.Minute
+	r.NewLocker = func(name string) (lock.Locker, error) {
+		return newLocker(aws.Config{}, &storage.Resolver{}, r.Config, lock.TokenOwner("tester"), name)
+	}
+
+	deb := filepath.Join(t.TempDir(), "mkr_0.60.0_amd64.deb")
+	if err := os.WriteFile(deb, buildDeb(t, "mkr", "0.60.0", "amd64"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Upload(ctx, []string{deb}); err != nil {
+		t.Fatal(err)
+	}
+	if list, err := r.List(ctx); err != nil || len(list) != 1 {
+		t.Fatal(list, err)
+	}
+}
+
+// unavailable fails to stat and list files, as a denied or throttled request.
+type unavailable struct {
+	*storage.Memory
+}
+
+var errUnavailable = errors.New("service unavailable")
+
+func (unavailable) ExistFile(context.Context, string) (bool, error) {
+	return false, errUnavailable
+}
+
+func (unavailable) FindPackages(context.Context, string) ([]string, error) {
+	return nil, errUnavailable
+}
+
+func TestUnavailable(t *testing.T) {
+	r, fs, incoming := newTestRepository(t)
+	ctx := t.Context()
+
+	if err := incoming.WriteFile(ctx, "mkr_0.60.0_amd64.deb", buildDeb(t, "mkr", "0.60.0", "amd64"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile(ctx, "debian/dists/stable/main/binary-amd64/Packages", []byte("Package: mackerel-agent\n"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	r.FS = unavailable{fs}
+	if err := r.Add(ctx, uploaded("incoming", "mkr_0.60.0_amd64.deb")); !errors.Is(err, errUnavailable) {
+		t.Fatal(err)
+	}
+	if err := r.Regenerate(ctx); !errors.Is(err, errUnavailable) {
+		t.Fatal(err)
+	}
+	if got := readString(t, fs, "debian/dists/stable/main/binary-amd64/Packages"); got != "Package: mackerel-agent\n" {
+		t.Fatalf("Packages is overwritten:\n%s", got)
+	}
+}
+
+// racing writes Packages as another writer, after it is read.
+type racing struct {
+	*storage.Memory
+}
+
+func (r racing) GetFile(ctx context.Context, name string) ([]byte, storage.Object, error) {
+	b, object, err := r.Memory.GetFile(ctx, name)
+	if err == nil && path.Base(name) == "Packages" {
+		err = r.Memory.WriteFile(ctx, name, []byte("Package: other\n"), nil)
+	}
+	return b, object, err
+}
+
+func TestConcurrentWriter(t *testing.T) {
+	r, fs, incoming := newTestRepository(t)
+	ctx := t.Context()
+
+	if err := incoming.WriteFile(ctx, "mkr_0.60.0_amd64.deb", buildDeb(t, "mkr", "0.60.0", "amd64"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile(ctx, "debian/dists/stable/main/binary-amd64/Packages", []byte("Package: mackerel-agent\n"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	r.FS = racing{fs}
+	if err := r.Add(ctx, uploaded("incoming", "mkr_0.60.0_amd64.deb")); !storage.IsConditionFailed(err) {
+		t.Fatal(err)
+	}
+	if got := readString(t, fs, "debian/dists/stable/main/binary-amd64/Packages"); got != "Package: other\n" {
+		t.Fatalf("Packages is overwritten:\n%s", got)
+	}
+}
+
+func TestNewS3Client(t *testing.T) {
+	cfg := aws.Config{Region: "ap-northeast-1", Credentials: aws.AnonymousCredentials{}}
+
+	client, err := newS3Client(cfg, config.S3Client{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := client.Options()
+	if !o.UsePathStyle || o.Region != "ap-northeast-1" || o.BaseEndpoint != nil || aws.IsCredentialsProvider(o.Credentials, (*stscreds.AssumeRoleProvider)(nil)) {
+		t.Fatalf("unexpected options: %+v", o)
+	}
+
+	pathStyle := false
+	client, err = newS3Client(cfg, config.S3Client{
+		Region:  "us-east-1",
+		RoleARN: "arn:aws:iam::123456789012:role/apt-s3",
+		LogMode: []string{"retries", "request"},
+	}.Or(config.S3Client{
+		Region:      "eu-west-1",
+		Endpoint:    "http://localhost:9000",
+		PathStyle:   &pathStyle,
+		RetryMode:   "adaptive",
+		MaxAttempts: 5,
+		LogMode:     []string{"response"},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	o = client.Options()
+	if o.UsePathStyle || o.RetryMode != aws.RetryModeAdaptive || o.RetryMaxAttempts != 5 || o.ClientLogMode != aws.LogRetries|aws.LogRequest {
+		t.Fatalf("unexpected options: %+v", o)
+	}
+	if o.Region != "us-east-1" || aws.ToString(o.BaseEndpoint) != "http://localhost:9000" || !aws.IsCredentialsProvider(o.Credentials, (*stscreds.AssumeRoleProvider)(nil)) {
+		t.Fatalf("unexpected options: %+v", o)
+	}
+
+	if _, err := newS3Client(cfg, config.S3Client{LogMode: []string{"everything"}}); err == nil {
+		t.Fatal("unknown log mode is accepted")
+	}
+
+	db, err := newDynamoDBClient(cfg, config.S3Client{
+		Region:   "us-east-1",
+		Endpoint: "http://localhost:4566",
+		RoleARN:  "arn:aws:iam::123456789012:role/apt-s3",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o := db.Options(); o.Region != "us-east-1" || aws.ToString(o.BaseEndpoint) != "http://localhost:4566" || !aws.IsCredentialsProvider(o.Credentials, (*stscreds.AssumeRoleProvider)(nil)) {
+		t.Fatalf("unexpected options: %+v", o)
+	}
+}
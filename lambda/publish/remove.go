@@ -0,0 +1,124 @@
+package publish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/yseto/apt-s3/lambda/config"
+	"github.com/yseto/apt-s3/lambda/packages"
+	"github.com/yseto/apt-s3/lambda/snapshot"
+	"github.com/yseto/apt-s3/lambda/storage"
+)
+
+// remove removes the entries matching filters from the indexes of the
+// component, and returns the pool files of them.
+func remove(ctx context.Context, fs storage.Impl, aptConfig config.Config, filters []packages.Filter) (removed []string, err error) {
+	filePaths, err := fs.FindPackages(ctx, aptConfig.BaseDir)
+	if err != nil {
+		return
+	}
+
+	match := func(e packages.Entry) bool {
+		return slices.ContainsFunc(filters, func(f packages.Filter) bool {
+			return f.Match(e)
+		})
+	}
+
+	for _, filePath := range filePaths {
+		if filepath.Base(filePath) != "Packages" || filepath.Dir(filepath.Dir(filePath)) != aptConfig.DirName() {
+			continue
+		}
+
+		b, object, err := fs.GetFile(ctx, filePath)
+		if err != nil {
+			return nil, err
+		}
+		entries, err := packages.Parse(b)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filePath, err)
+		}
+
+		var contents []string
+		for _, entry := range entries {
+			if match(entry) {
+				fmt.Printf("remove %s from %s\n", entry.Filename, aptConfig.Distribution)
+				removed = append(removed, entry.Filename)
+				continue
+			}
+			contents = append(contents, entry.Control)
+		}
+		if len(contents) == len(entries) {
+			continue
+		}
+
+		// Packages is written only if it is not changed since it was read.
+		if err := writePackages(ctx, fs, filePath, []byte(strings.Join(contents, "\r\n")), storage.Condition{IfMatch: object.ETag}); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(removed) == 0 {
+		err = errors.New("no packages match")
+	}
+	return
+}
+
+// prune deletes the pool files in removed, which no index of the distributions
+// or the snapshots refers to.
+func prune(ctx context.Context, fs storage.Impl, aptConfig config.Config, removed []string) error {
+	filePaths, err := fs.FindPackages(ctx, aptConfig.BaseDir)
+	if err != nil {
+		return err
+	}
+
+	var referred = make(map[string]bool)
+	for _, filePath := range filePaths {
+		if filepath.Base(filePath) != "Packages" {
+			continue
+		}
+
+		b, err := fs.ReadFile(ctx, filePath)
+		if err != nil {
+			return err
+		}
+		entries, err := packages.Parse(b)
+		if err != nil {
+			return fmt.Errorf("%s: %w", filePath, err)
+		}
+		for _, entry := range entries {
+			referred[entry.Filename] = true
+		}
+	}
+
+	snapshots, err := snapshot.List(ctx, fs, aptConfig.BaseDir)
+	if err != nil {
+		return err
+	}
+	for _, m := range snapshots {
+		for _, filename := range m.Pool {
+			referred[filename] = true
+		}
+	}
+
+	for _, filename := range removed {
+		if referred[filename] {
+			continue
+		}
+		// marked, as removed may have the same file of architectures.
+		referred[filename] = true
+
+		key := filepath.Join(aptConfig.BaseDir, filename)
+		fmt.Printf("delete %s\n", key)
+		if err := fs.DeleteFile(ctx, key); err != nil {
+			return err
+		}
+		if err := fs.DeleteFile(ctx, packages.MetadataPath(key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
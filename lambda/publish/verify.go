@@ -0,0 +1,152 @@
+package publish
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/yseto/apt-s3/lambda/packages"
+	"github.com/yseto/apt-s3/lambda/release"
+	"github.com/yseto/apt-s3/lambda/sign"
+	"github.com/yseto/apt-s3/lambda/storage"
+)
+
+// List returns the entries of the indexes of the distribution, sorted by the
+// file name.
+func (r *Repository) List(ctx context.Context) (list []packages.Entry, err error) {
+	filePaths, err := r.FS.FindPackages(ctx, r.Config.BaseDir)
+	if err != nil {
+		return
+	}
+
+	for _, filePath := range filePaths {
+		if filepath.Base(filePath) != "Packages" || !strings.HasPrefix(filePath, r.Config.DistributionDirName()+"/") {
+			continue
+		}
+
+		b, err := r.FS.ReadFile(ctx, filePath)
+		if err != nil {
+			return nil, err
+		}
+		entries, err := packages.Parse(b)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filePath, err)
+		}
+		list = append(list, entries...)
+	}
+
+	slices.SortFunc(list, func(a, b packages.Entry) int {
+		return strings.Compare(a.Filename, b.Filename)
+	})
+	return
+}
+
+// Verify checks the signatures of `Release`, the digests of the indexes in
+// it, and the pool files the indexes refer to. Every problem is printed.
+func (r *Repository) Verify(ctx context.Context) error {
+	distributionDirName := r.Config.DistributionDirName()
+
+	var files = make(map[string][]byte)
+	for _, name := range []string{"Release", "InRelease", "Release.gpg"} {
+		b, err := r.FS.ReadFile(ctx, filepath.Join(distributionDirName, name))
+		if err != nil {
+			return err
+		}
+		files[name] = b
+	}
+
+	var problems int
+	report := func(format string, a ...any) {
+		problems++
+		fmt.Printf(format+"\n", a...)
+	}
+
+	if err := sign.Verify(files["Release"], files["InRelease"], files["Release.gpg"], r.PrivKey); err != nil {
+		report("%s: %s", distributionDirName, err)
+	}
+
+	hashes, err := release.Hashes(files["Release"], "SHA256")
+	if err != nil {
+		return err
+	}
+	for _, h := range hashes {
+		name := filepath.Join(distributionDirName, h.Filename)
+		// hashed, as the metadata is written with the file.
+		b, err := r.FS.ReadFile(ctx, name)
+		switch {
+		case storage.IsNotExist(err):
+			report("%s: missing", name)
+			continue
+		case err != nil:
+			return err
+		}
+		d, err := packages.Sum(bytes.NewReader(b))
+		switch {
+		case err != nil:
+			return err
+		case d.SHA256 != h.Hash || d.Size != h.Size:
+			report("%s: digest does not match Release", name)
+		}
+	}
+
+	list, err := r.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, entry := range list {
+		name := filepath.Join(r.Config.BaseDir, entry.Filename)
+		d, err := poolDigest(ctx, r.FS, name)
+		switch {
+		case storage.IsNotExist(err):
+			report("%s: missing", name)
+		case err != nil:
+			return err
+		case d.Size != entry.Size || d.SHA256 != entry.Values["SHA256"]:
+			report("%s: digest does not match the index", name)
+		}
+	}
+
+	if problems > 0 {
+		return fmt.Errorf("%d problems in %s", problems, distributionDirName)
+	}
+	fmt.Printf("%s is valid\n", distributionDirName)
+	return nil
+}
+
+// poolDigest returns the digest of a pool file from the object metadata, or
+// its sidecar, and hashes the file when it has neither.
+func poolDigest(ctx context.Context, fs storage.Impl, name string) (d packages.Digest, err error) {
+	object, err := fs.StatFile(ctx, name)
+	if err != nil {
+		return
+	}
+	if d, ok := packages.DigestFromMetadata(object.Size, object.Metadata); ok {
+		return d, nil
+	}
+
+	b, err := fs.ReadFile(ctx, packages.MetadataPath(name))
+	switch {
+	case storage.IsNotExist(err):
+	case err != nil:
+		return
+	default:
+		var m packages.Metadata
+		if json.Unmarshal(b, &m) == nil && m.ETag == object.ETag {
+			entries, errP := packages.Parse([]byte(m.ControlWithStat))
+			if errP == nil && len(entries) == 1 && entries[0].Values["SHA256"] != "" {
+				return packages.Digest{Size: object.Size, SHA256: entries[0].Values["SHA256"]}, nil
+			}
+		}
+	}
+
+	body, err := fs.Open(ctx, name)
+	if err != nil {
+		return
+	}
+	defer body.Close()
+	return packages.Sum(body)
+}
@@ -2,6 +2,8 @@ package release
 
 import (
 	"bytes"
+	"fmt"
+	"strconv"
 	"strings"
 	"text/template"
 )
@@ -14,6 +16,8 @@ Date: {{.Date}}
 Architectures: {{join .Architectures " "}}
 Components: {{.Components}}
 Description: {{.Description}}
+{{if .AcquireByHash}}Acquire-By-Hash: yes
+{{end -}}
 MD5Sum:
 {{range .MD5Sum}} {{.Hash}} {{.Size}} {{.Filename}}
 {{end -}}
@@ -34,6 +38,7 @@ type Release struct {
 	Architectures []string
 	Components    string
 	Description   string
+	AcquireByHash bool
 	MD5Sum        []Hash
 	SHA1          []Hash
 	SHA256        []Hash
@@ -55,3 +60,29 @@ func Generate(r Release) (string, error) {
 	}
 	return buf.String(), nil
 }
+
+// Hashes returns the hashes of the field of a `Release`, such as "SHA256".
+func Hashes(release []byte, field string) (hashes []Hash, err error) {
+	var in bool
+	for line := range strings.Lines(string(release)) {
+		line = strings.TrimRight(line, "\r\n")
+		if !strings.HasPrefix(line, " ") {
+			in = line == field+":"
+			continue
+		}
+		if !in {
+			continue
+		}
+
+		f := strings.Fields(line)
+		if len(f) != 3 {
+			return nil, fmt.Errorf("invalid %s line: %q", field, line)
+		}
+		size, err := strconv.ParseInt(f[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s line: %q", field, line)
+		}
+		hashes = append(hashes, Hash{Hash: f[0], Size: size, Filename: f[2]})
+	}
+	return
+}
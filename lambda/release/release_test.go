@@ -42,4 +42,12 @@ func TestGenerate(t *testing.T) {
 	// TODO improve tests.
 	t.Log(res)
 
+	hashes, err := Hashes([]byte(res), "SHA256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes) != 1 || hashes[0].Size != 2210 || hashes[0].Filename != "contrib/binary-amd64/Packages" || hashes[0].Hash != "c853aa191454968fbedb1110432e6f9bce097c4a4fba7b7105b80c2d179437eb" {
+		t.Fatal(hashes)
+	}
+
 }
@@ -0,0 +1,180 @@
+// Package serve serves a repository over HTTP, as the static website of the
+// bucket does, for development.
+package serve
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"maps"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/yseto/apt-s3/lambda/packages"
+	"github.com/yseto/apt-s3/lambda/storage"
+)
+
+// Handler serves the files of FS with Range requests, and lists the
+// directories.
+type Handler struct {
+	FS storage.Impl
+	// Upload adds a package uploaded with PUT or POST, nil to refuse the
+	// uploads.
+	Upload func(ctx context.Context, name string, body io.Reader) error
+	// MaxUploadSize is the size of an uploaded package at most,
+	// DefaultMaxUploadSize when 0.
+	MaxUploadSize int64
+}
+
+// DefaultMaxUploadSize is 1GiB, as the uploads are spooled to a file.
+const DefaultMaxUploadSize = 1 << 30
+
+var _ http.Handler = (*Handler)(nil)
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+
+	switch {
+	case r.Method == http.MethodGet, r.Method == http.MethodHead:
+		h.get(w, r, name)
+	case (r.Method == http.MethodPut || r.Method == http.MethodPost) && h.Upload != nil:
+		h.put(w, r, name)
+	default:
+		allow := "GET, HEAD"
+		if h.Upload != nil {
+			allow += ", PUT, POST"
+		}
+		w.Header().Set("Allow", allow)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) get(w http.ResponseWriter, r *http.Request, name string) {
+	if name != "" && !strings.HasSuffix(r.URL.Path, "/") {
+		f, err := h.FS.OpenFile(r.Context(), name)
+		switch {
+		case err == nil:
+			defer f.Close()
+			serveFile(w, r, f)
+			return
+		case !storage.IsNotExist(err):
+			fmt.Println("can not open", name, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	h.list(w, r, name)
+}
+
+// serveFile serves f with its headers, or the ones by its name.
+func serveFile(w http.ResponseWriter, r *http.Request, f storage.File) {
+	object := f.Object()
+
+	if contentType := cmp.Or(object.Headers.ContentType, storage.ContentType(object.Key)); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	if object.Headers.CacheControl != "" {
+		w.Header().Set("Cache-Control", object.Headers.CacheControl)
+	}
+	if object.ETag != "" {
+		w.Header().Set("ETag", `"`+strings.Trim(object.ETag, `"`)+`"`)
+	}
+
+	http.ServeContent(w, r, path.Base(object.Key), object.LastModified, io.NewSectionReader(f, 0, f.Size()))
+}
+
+var listTemplate = template.Must(template.New("list").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Index of /{{.Dir}}</title></head>
+<body>
+<h1>Index of /{{.Dir}}</h1>
+<pre>
+{{if .Dir}}<a href="../">../</a>
+{{end}}{{range .Entries}}<a href="{{.}}">{{.}}</a>
+{{end}}</pre>
+</body>
+</html>
+`))
+
+// list serves the files and the directories in the directory name.
+func (h *Handler) list(w http.ResponseWriter, r *http.Request, name string) {
+	files, err := h.FS.FindFiles(r.Context(), name)
+	if err != nil {
+		fmt.Println("can not list", name, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	var prefix string
+	if name != "" {
+		prefix = name + "/"
+	}
+
+	var entries = make(map[string]bool)
+	for _, file := range files {
+		rest, ok := strings.CutPrefix(file, prefix)
+		if !ok || rest == "" {
+			continue
+		}
+		if dir, _, ok := strings.Cut(rest, "/"); ok {
+			entries[dir+"/"] = true
+		} else {
+			entries[rest] = true
+		}
+	}
+
+	if len(entries) == 0 && name != "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		// the links are relative to the directory.
+		http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = listTemplate.Execute(w, struct {
+		Dir     string
+		Entries []string
+	}{
+		Dir:     prefix,
+		Entries: slices.Sorted(maps.Keys(entries)),
+	})
+	if err != nil {
+		fmt.Println("can not list", name, err)
+	}
+}
+
+// put adds the uploaded package.
+func (h *Handler) put(w http.ResponseWriter, r *http.Request, name string) {
+	base := path.Base(name)
+	if path.Ext(base) != ".deb" {
+		http.Error(w, "not a package: "+base, http.StatusBadRequest)
+		return
+	}
+
+	body := http.MaxBytesReader(w, r.Body, cmp.Or(h.MaxUploadSize, DefaultMaxUploadSize))
+	err := h.Upload(r.Context(), base, body)
+
+	var tooLarge *http.MaxBytesError
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusCreated)
+	case errors.As(err, &tooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, packages.ErrInvalid):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	default:
+		// the storage or the lock failed.
+		fmt.Println("can not add", base, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,116 @@
+package serve
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/yseto/apt-s3/lambda/packages"
+	"github.com/yseto/apt-s3/lambda/storage"
+)
+
+func TestHandler(t *testing.T) {
+	ctx := t.Context()
+	fs := storage.NewMemory()
+	for name, data := range map[string]string{
+		"debian/dists/stable/Release":           "Origin: tester\n",
+		"debian/pool/main/m/mkr/mkr_0.60.0.deb": "0123456789",
+	} {
+		if err := fs.WriteFile(ctx, name, []byte(data), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var uploaded string
+	var uploadErr error
+	h := &Handler{
+		FS: fs,
+		Upload: func(ctx context.Context, name string, body io.Reader) error {
+			b, err := io.ReadAll(body)
+			uploaded = name + ":" + string(b)
+			return cmp.Or(err, uploadErr)
+		},
+		MaxUploadSize: 8,
+	}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	do := func(method, path string, header http.Header, body io.Reader) (*http.Response, string) {
+		t.Helper()
+		req, err := http.NewRequestWithContext(ctx, method, srv.URL+path, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header != nil {
+			req.Header = header
+		}
+		client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}}
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res, string(b)
+	}
+
+	res, body := do(http.MethodGet, "/debian/dists/stable/Release", nil, nil)
+	if res.StatusCode != http.StatusOK || body != "Origin: tester\n" || res.Header.Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Fatal(res.Status, res.Header, body)
+	}
+
+	res, body = do(http.MethodGet, "/debian/pool/main/m/mkr/mkr_0.60.0.deb", http.Header{"Range": {"bytes=2-4"}}, nil)
+	if res.StatusCode != http.StatusPartialContent || body != "234" || res.Header.Get("Content-Type") != "application/vnd.debian.binary-package" {
+		t.Fatal(res.Status, res.Header, body)
+	}
+
+	res, body = do(http.MethodGet, "/debian/", nil, nil)
+	if res.StatusCode != http.StatusOK || !strings.Contains(body, `<a href="dists/">dists/</a>`) || !strings.Contains(body, `<a href="pool/">pool/</a>`) {
+		t.Fatal(res.Status, body)
+	}
+	if res, _ = do(http.MethodGet, "/", nil, nil); res.StatusCode != http.StatusOK {
+		t.Fatal(res.Status)
+	}
+	if res, _ = do(http.MethodGet, "/debian/dists", nil, nil); res.StatusCode != http.StatusMovedPermanently || res.Header.Get("Location") != "/debian/dists/" {
+		t.Fatal(res.Status, res.Header)
+	}
+	if res, _ = do(http.MethodGet, "/debian/missing", nil, nil); res.StatusCode != http.StatusNotFound {
+		t.Fatal(res.Status)
+	}
+
+	if res, _ = do(http.MethodPut, "/mkr_0.61.0.deb", nil, strings.NewReader("deb")); res.StatusCode != http.StatusCreated || uploaded != "mkr_0.61.0.deb:deb" {
+		t.Fatal(res.Status, uploaded)
+	}
+	if res, _ = do(http.MethodPut, "/Release", nil, strings.NewReader("deb")); res.StatusCode != http.StatusBadRequest {
+		t.Fatal(res.Status)
+	}
+
+	if res, _ = do(http.MethodPut, "/mkr_0.61.0.deb", nil, strings.NewReader("too large deb")); res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatal(res.Status)
+	}
+
+	uploadErr = fmt.Errorf("mkr_0.61.0.deb: %w", packages.ErrInvalid)
+	if res, _ = do(http.MethodPut, "/mkr_0.61.0.deb", nil, strings.NewReader("deb")); res.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatal(res.Status)
+	}
+	uploadErr = errors.New("lock is held")
+	if res, _ = do(http.MethodPut, "/mkr_0.61.0.deb", nil, strings.NewReader("deb")); res.StatusCode != http.StatusInternalServerError {
+		t.Fatal(res.Status)
+	}
+
+	h.Upload = nil
+	if res, _ = do(http.MethodPut, "/mkr_0.61.0.deb", nil, strings.NewReader("deb")); res.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatal(res.Status)
+	}
+}
@@ -2,78 +2,112 @@ package sign
 
 import (
 	"context"
-	"io"
-	"net/url"
+	"errors"
+	"fmt"
 	"path/filepath"
 	"strings"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/yseto/apt-s3/lambda/config"
 	"github.com/yseto/apt-s3/lambda/storage"
 
 	"github.com/ProtonMail/gopenpgp/v3/crypto"
 )
 
-func ReadKey(ctx context.Context, s3Client *s3.Client, s3url string) (*crypto.Key, error) {
-	u, err := url.Parse(s3url)
+// ReadKey reads the armored private key at a URL of the resolver.
+func ReadKey(ctx context.Context, resolver *storage.Resolver, rawurl string) (*crypto.Key, error) {
+	b, err := resolver.ReadURL(ctx, rawurl)
 	if err != nil {
 		return nil, err
 	}
+	return crypto.NewPrivateKeyFromArmored(string(b), []byte{})
+}
 
-	o, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
-		Bucket: aws.String(u.Host),
-		Key:    aws.String(strings.TrimPrefix(u.Path, "/")),
-	})
+func Do(ctx context.Context, fs storage.Impl, aptConfig config.Config, privKey *crypto.Key) error {
+	distributionDirName := aptConfig.DistributionDirName()
+
+	b, err := fs.ReadFile(ctx, filepath.Join(distributionDirName, "Release"))
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer o.Body.Close()
 
-	b, err := io.ReadAll(o.Body)
+	cleartextArmored, signature, err := Sign(b, privKey)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return crypto.NewPrivateKeyFromArmored(string(b), []byte{})
-}
 
-func Do(ctx context.Context, s3client *s3.Client, aptConfig config.Config, privKey *crypto.Key) error {
-	s3 := &storage.S3{
-		BucketName: aptConfig.DestS3Bucket,
-		S3Client:   s3client,
+	if err := fs.WriteFile(ctx, filepath.Join(distributionDirName, "Release.gpg"), signature, nil); err != nil {
+		return err
 	}
-	distributionDirName := aptConfig.DistributionDirName()
 
-	b, err := s3.ReadFile(ctx, filepath.Join(distributionDirName, "Release"))
-	if err != nil {
+	if err := fs.WriteFile(ctx, filepath.Join(distributionDirName, "InRelease"), cleartextArmored, nil); err != nil {
 		return err
 	}
 
+	return nil
+}
+
+// Sign returns the content of `InRelease` and `Release.gpg` for `Release`.
+func Sign(release []byte, privKey *crypto.Key) (inRelease, releaseGPG []byte, err error) {
 	pgp := crypto.PGP()
 	signer, err := pgp.Sign().SigningKey(privKey).New()
 	if err != nil {
-		return err
+		return
 	}
 
 	// InRelease
-	cleartextArmored, err := signer.SignCleartext(b)
+	inRelease, err = signer.SignCleartext(release)
 	if err != nil {
-		return err
+		return
 	}
 
-	if err := s3.WriteFile(ctx, filepath.Join(distributionDirName, "InRelease"), cleartextArmored); err != nil {
-		return err
+	// Release.gpg, a detached signature.
+	detached, err := pgp.Sign().SigningKey(privKey).Detached().New()
+	if err != nil {
+		return
 	}
+	releaseGPG, err = detached.Sign(release, crypto.Armor)
+	return
+}
 
-	// Release.gpg
-	signature, err := signer.Sign(b, crypto.Armor)
+// Verify checks that `InRelease` and `Release.gpg` are the signatures of
+// `Release` by key.
+func Verify(release, inRelease, releaseGPG []byte, key *crypto.Key) error {
+	publicKey, err := key.ToPublic()
 	if err != nil {
 		return err
 	}
-
-	if err := s3.WriteFile(ctx, filepath.Join(distributionDirName, "Release.gpg"), signature); err != nil {
+	verifier, err := crypto.PGP().Verify().VerificationKey(publicKey).New()
+	if err != nil {
 		return err
 	}
 
+	cleartext, err := verifier.VerifyCleartext(inRelease)
+	if err != nil {
+		return fmt.Errorf("InRelease: %w", err)
+	}
+	if err := cleartext.SignatureError(); err != nil {
+		return fmt.Errorf("InRelease: %w", err)
+	}
+	if canonical(cleartext.Cleartext()) != canonical(release) {
+		return errors.New("InRelease: does not match Release")
+	}
+
+	detached, err := verifier.VerifyDetached(release, releaseGPG, crypto.Armor)
+	if err != nil {
+		return fmt.Errorf("Release.gpg: %w", err)
+	}
+	if err := detached.SignatureError(); err != nil {
+		return fmt.Errorf("Release.gpg: %w", err)
+	}
 	return nil
 }
+
+// canonical strips the trailing whitespace of the lines, and the last newline,
+// as the cleartext signature does.
+func canonical(b []byte) string {
+	var lines []string
+	for line := range strings.Lines(string(b)) {
+		lines = append(lines, strings.TrimRight(line, " \t\r\n"))
+	}
+	return strings.TrimRight(strings.Join(lines, "\n"), "\n")
+}
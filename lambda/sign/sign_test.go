@@ -0,0 +1,27 @@
+package sign
+
+import (
+	"testing"
+
+	"github.com/ProtonMail/gopenpgp/v3/crypto"
+)
+
+func TestVerify(t *testing.T) {
+	privKey, err := crypto.PGP().KeyGeneration().AddUserId("tester", "tester@example.com").New().GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an empty field ends with a space, which the cleartext strips.
+	release := []byte("Origin: tester\nDescription: \nSuite: stable\n")
+	inRelease, releaseGPG, err := Sign(release, privKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(release, inRelease, releaseGPG, privKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify([]byte("Origin: mallory\n"), inRelease, releaseGPG, privKey); err == nil {
+		t.Fatal("another Release is verified")
+	}
+}
@@ -0,0 +1,216 @@
+package snapshot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/yseto/apt-s3/lambda/packages"
+	"github.com/yseto/apt-s3/lambda/storage"
+)
+
+const manifestName = "snapshot.json"
+
+// Manifest describes a snapshot of a distribution. The index files are copied
+// under the snapshot directory, and the pool files are referenced as is.
+type Manifest struct {
+	Name         string    `json:"name"`
+	Distribution string    `json:"distribution"`
+	CreatedAt    time.Time `json:"created_at"`
+	Files        []string  `json:"files"`
+	Pool         []string  `json:"pool"`
+	// Prefix is the directory of the index copies in the snapshot directory.
+	// It is the distribution, as the snapshots of the distributions may run
+	// at the same time, and is empty for the older snapshots.
+	Prefix string `json:"prefix,omitempty"`
+}
+
+// Dir returns the directory of the snapshot.
+func Dir(baseDir, name string) string {
+	return filepath.Join(baseDir, "snapshots", name)
+}
+
+func validName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid snapshot name: %q", name)
+	}
+	return nil
+}
+
+// Create copies the indexes of distribution into the snapshot name. A snapshot
+// is never overwritten.
+func Create(ctx context.Context, fs storage.Impl, baseDir, distribution, name string) (m Manifest, err error) {
+	if err = validName(name); err != nil {
+		return
+	}
+
+	dir := Dir(baseDir, name)
+	exist, err := fs.ExistFile(ctx, filepath.Join(dir, manifestName))
+	if err != nil {
+		return
+	}
+	if exist {
+		return m, fmt.Errorf("snapshot %s: %w", name, storage.ErrExist)
+	}
+
+	distributionDirName := filepath.Join(baseDir, "dists", distribution)
+	filePaths, err := fs.FindPackages(ctx, baseDir)
+	if err != nil {
+		return
+	}
+
+	m = Manifest{
+		Name:         name,
+		Distribution: distribution,
+		CreatedAt:    time.Now().UTC(),
+		Prefix:       distribution,
+	}
+
+	pool := make(map[string]bool)
+	for _, filePath := range filePaths {
+		path, err := filepath.Rel(distributionDirName, filePath)
+		if err != nil {
+			return m, err
+		}
+
+		// another distribution.
+		if strings.HasPrefix(path, "..") {
+			continue
+		}
+
+		b, err := fs.ReadFile(ctx, filePath)
+		if err != nil {
+			return m, err
+		}
+
+		if filepath.Base(path) == "Packages" {
+			entries, err := packages.Parse(b)
+			if err != nil {
+				return m, fmt.Errorf("%s: %w", filePath, err)
+			}
+			for _, entry := range entries {
+				pool[entry.Filename] = true
+			}
+		}
+
+		if err := packages.WriteIndex(ctx, fs, filepath.Join(dir, m.Prefix, path), b); err != nil {
+			return m, err
+		}
+		m.Files = append(m.Files, path)
+	}
+
+	if len(m.Files) == 0 {
+		return m, fmt.Errorf("distribution %s has no indexes", distribution)
+	}
+
+	for filename := range pool {
+		m.Pool = append(m.Pool, filename)
+	}
+	slices.Sort(m.Pool)
+
+	// the manifest is written last, a partial snapshot is not listed. it is
+	// written only if absent, as another distribution may create the same
+	// name.
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return
+	}
+	_, err = fs.WriteFileIf(ctx, filepath.Join(dir, manifestName), b, nil, storage.Condition{IfNoneMatch: true})
+	if storage.IsConditionFailed(err) {
+		// the copies of the other distribution are under its prefix.
+		errs := []error{fmt.Errorf("snapshot %s: %w", name, storage.ErrExist)}
+		for _, path := range m.Files {
+			errs = append(errs, fs.DeleteFile(ctx, filepath.Join(dir, m.Prefix, path)))
+		}
+		err = errors.Join(errs...)
+	}
+	return
+}
+
+// Load reads the manifest of the snapshot name.
+func Load(ctx context.Context, fs storage.Impl, baseDir, name string) (m Manifest, err error) {
+	if err = validName(name); err != nil {
+		return
+	}
+
+	b, err := fs.ReadFile(ctx, filepath.Join(Dir(baseDir, name), manifestName))
+	if err != nil {
+		return m, fmt.Errorf("snapshot %s: %w", name, err)
+	}
+
+	err = json.Unmarshal(b, &m)
+	return
+}
+
+// List returns the snapshots, ordered by name.
+func List(ctx context.Context, fs storage.Impl, baseDir string) (list []Manifest, err error) {
+	names, err := fs.FindFiles(ctx, filepath.Join(baseDir, "snapshots"))
+	if err != nil {
+		return
+	}
+
+	for _, name := range names {
+		if filepath.Base(name) != manifestName {
+			continue
+		}
+		m, err := Load(ctx, fs, baseDir, filepath.Base(filepath.Dir(name)))
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, m)
+	}
+	return
+}
+
+// Restore writes the indexes of the snapshot into distribution, and removes
+// the indexes the snapshot does not have. `Release` is not restored, it must
+// be generated and signed again for distribution.
+func Restore(ctx context.Context, fs storage.Impl, baseDir string, m Manifest, distribution string) error {
+	var missing []string
+	for _, filename := range m.Pool {
+		exist, err := fs.ExistFile(ctx, filepath.Join(baseDir, filename))
+		if err != nil {
+			return err
+		}
+		if !exist {
+			missing = append(missing, filename)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("snapshot %s: missing pool files: %s", m.Name, strings.Join(missing, ", "))
+	}
+
+	distributionDirName := filepath.Join(baseDir, "dists", distribution)
+	dir := Dir(baseDir, m.Name)
+
+	var errs []error
+	for _, path := range m.Files {
+		b, err := fs.ReadFile(ctx, filepath.Join(dir, m.Prefix, path))
+		if err != nil {
+			return err
+		}
+		if err := packages.WriteIndex(ctx, fs, filepath.Join(distributionDirName, path), b); err != nil {
+			return err
+		}
+	}
+
+	current, err := fs.FindPackages(ctx, baseDir)
+	if err != nil {
+		return err
+	}
+	for _, filePath := range current {
+		path, err := filepath.Rel(distributionDirName, filePath)
+		if err != nil || strings.HasPrefix(path, "..") {
+			continue
+		}
+		if !slices.Contains(m.Files, path) {
+			errs = append(errs, fs.DeleteFile(ctx, filePath))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,132 @@
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"path"
+	"slices"
+	"testing"
+
+	"github.com/yseto/apt-s3/lambda/storage"
+)
+
+func TestSnapshot(t *testing.T) {
+	ctx := t.Context()
+	fs := storage.NewMemory()
+
+	const packagesName = "debian/dists/stable/main/binary-amd64/Packages"
+	for name, data := range map[string]string{
+		packagesName:                  "Package: mkr\nFilename: pool/main/m/mkr/mkr_0.60.0_amd64.deb\nSize: 3\n",
+		"debian/dists/stable/Release": "Origin: tester\n",
+		"debian/dists/testing/main/binary-arm64/Packages": "Package: other\nFilename: pool/main/o/other/other_1.0_amd64.deb\nSize: 3\n",
+		"debian/pool/main/m/mkr/mkr_0.60.0_amd64.deb":     "deb",
+	} {
+		if err := fs.WriteFile(ctx, name, []byte(data), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m, err := Create(ctx, fs, "debian", "stable", "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(m.Files, []string{"main/binary-amd64/Packages"}) || !slices.Equal(m.Pool, []string{"pool/main/m/mkr/mkr_0.60.0_amd64.deb"}) {
+		t.Fatalf("unexpected manifest: %+v", m)
+	}
+
+	if _, err := Create(ctx, fs, "debian", "stable", "s1"); !errors.Is(err, storage.ErrExist) {
+		t.Fatal("snapshot is overwritten", err)
+	}
+	if _, err := Create(ctx, fs, "debian", "stable", "../s1"); err == nil {
+		t.Fatal("invalid name is accepted")
+	}
+
+	list, err := List(ctx, fs, "debian")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Name != "s1" || list[0].Distribution != "stable" {
+		t.Fatalf("unexpected snapshots: %+v", list)
+	}
+
+	// restored as testing, whose other indexes are removed.
+	if err := Restore(ctx, fs, "debian", m, "testing"); err != nil {
+		t.Fatal(err)
+	}
+	b, err := fs.ReadFile(ctx, "debian/dists/testing/main/binary-amd64/Packages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, _ := fs.ReadFile(ctx, packagesName); string(b) != string(want) {
+		t.Fatalf("Packages:\n%s", b)
+	}
+	if exist, err := fs.ExistFile(ctx, "debian/dists/testing/main/binary-arm64/Packages"); err != nil || exist {
+		t.Fatal("index which the snapshot does not have is kept", err)
+	}
+
+	if err := fs.DeleteFile(ctx, "debian/pool/main/m/mkr/mkr_0.60.0_amd64.deb"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Restore(ctx, fs, "debian", m, "stable"); err == nil {
+		t.Fatal("restored without the pool files")
+	}
+}
+
+// racing runs before once, when the manifest is about to be written.
+type racing struct {
+	*storage.Memory
+	before func()
+}
+
+func (r *racing) WriteFileIf(ctx context.Context, name string, data []byte, metadata map[string]string, cond storage.Condition) (string, error) {
+	if before := r.before; before != nil && path.Base(name) == manifestName {
+		r.before = nil
+		before()
+	}
+	return r.Memory.WriteFileIf(ctx, name, data, metadata, cond)
+}
+
+func TestSnapshotRace(t *testing.T) {
+	ctx := t.Context()
+	fs := storage.NewMemory()
+	for name, data := range map[string]string{
+		"debian/dists/stable/main/binary-amd64/Packages":  "Package: mkr\nFilename: pool/main/m/mkr/mkr_0.60.0_amd64.deb\nSize: 3\n",
+		"debian/dists/testing/main/binary-amd64/Packages": "Package: other\nFilename: pool/main/o/other/other_1.0_amd64.deb\nSize: 3\n",
+		"debian/pool/main/o/other/other_1.0_amd64.deb":    "deb",
+	} {
+		if err := fs.WriteFile(ctx, name, []byte(data), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// testing creates the same name while stable copies its indexes.
+	var won Manifest
+	stable := &racing{Memory: fs, before: func() {
+		var err error
+		if won, err = Create(ctx, fs, "debian", "testing", "s1"); err != nil {
+			t.Error(err)
+		}
+	}}
+	if _, err := Create(ctx, stable, "debian", "stable", "s1"); !errors.Is(err, storage.ErrExist) {
+		t.Fatal("snapshot is overwritten", err)
+	}
+
+	m, err := Load(ctx, fs, "debian", "s1")
+	if err != nil || m.Distribution != "testing" || !m.CreatedAt.Equal(won.CreatedAt) {
+		t.Fatal(m, err)
+	}
+	files, err := fs.FindFiles(ctx, Dir("debian", "s1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"debian/snapshots/s1/snapshot.json", "debian/snapshots/s1/testing/main/binary-amd64/Packages"}; !slices.Equal(files, want) {
+		t.Fatalf("files of the snapshot: %v", files)
+	}
+
+	if err := Restore(ctx, fs, "debian", m, "stable"); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := fs.ReadFile(ctx, "debian/dists/stable/main/binary-amd64/Packages"); err != nil || string(b) != "Package: other\nFilename: pool/main/o/other/other_1.0_amd64.deb\nSize: 3\n" {
+		t.Fatal(string(b), err)
+	}
+}
@@ -0,0 +1,360 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+)
+
+// Azure stores the files in a container of Azure Blob Storage. The bucket of
+// a Source is a container of the same account.
+type Azure struct {
+	Client    *azblob.Client
+	Container string
+
+	// Policy sets the headers of the files written, nil for none.
+	Policy *Policy
+}
+
+var _ Impl = (*Azure)(nil)
+
+// the names of metadata are C# identifiers, so '-' is kept as '_'. the
+// service returns them capitalized.
+func azureMetadata(metadata map[string]string) map[string]*string {
+	if metadata == nil {
+		return nil
+	}
+	m := make(map[string]*string, len(metadata))
+	for k, v := range metadata {
+		m[strings.ReplaceAll(k, "-", "_")] = &v
+	}
+	return m
+}
+
+func fromAzureMetadata(metadata map[string]*string) map[string]string {
+	m := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		if v != nil {
+			m[strings.ReplaceAll(strings.ToLower(k), "_", "-")] = *v
+		}
+	}
+	return m
+}
+
+func azureError(name string, err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case bloberror.HasCode(err, bloberror.BlobNotFound, bloberror.ContainerNotFound):
+		return fmt.Errorf("%s: %w: %w", name, ErrNotExist, err)
+	case bloberror.HasCode(err, bloberror.ConditionNotMet, bloberror.BlobAlreadyExists):
+		return fmt.Errorf("%s: %w: %w", name, ErrConditionFailed, err)
+	}
+	return err
+}
+
+func value(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func etag(e *azcore.ETag) string {
+	if e == nil {
+		return ""
+	}
+	return strings.Trim(string(*e), `"`)
+}
+
+func (a *Azure) blob(container, name string) *blob.Client {
+	return a.Client.ServiceClient().NewContainerClient(container).NewBlobClient(name)
+}
+
+func (a *Azure) headers(name string) *blob.HTTPHeaders {
+	headers := a.Policy.Headers(name)
+	return &blob.HTTPHeaders{
+		BlobContentType:  optional(headers.ContentType),
+		BlobCacheControl: optional(headers.CacheControl),
+	}
+}
+
+func (a *Azure) upload(ctx context.Context, name string, data []byte, metadata map[string]string, conditions *blob.ModifiedAccessConditions) (string, error) {
+	resp, err := a.Client.UploadBuffer(ctx, a.Container, name, data, &azblob.UploadBufferOptions{
+		Metadata:         azureMetadata(a.Policy.apply(metadata)),
+		HTTPHeaders:      a.headers(name),
+		AccessConditions: &blob.AccessConditions{ModifiedAccessConditions: conditions},
+	})
+	if err != nil {
+		return "", azureError(name, err)
+	}
+	return etag(resp.ETag), nil
+}
+
+func (a *Azure) WriteFile(ctx context.Context, name string, data []byte, metadata map[string]string) error {
+	_, err := a.upload(ctx, name, data, metadata, nil)
+	return err
+}
+
+func (a *Azure) WriteFileIf(ctx context.Context, name string, data []byte, metadata map[string]string, cond Condition) (string, error) {
+	conditions := &blob.ModifiedAccessConditions{}
+	if cond.IfNoneMatch {
+		conditions.IfNoneMatch = to.Ptr(azcore.ETagAny)
+	}
+	if cond.IfMatch != "" {
+		conditions.IfMatch = to.Ptr(azcore.ETag(quote(cond.IfMatch)))
+	}
+	return a.upload(ctx, name, data, metadata, conditions)
+}
+
+func (a *Azure) DeleteFile(ctx context.Context, name string) error {
+	_, err := a.Client.DeleteBlob(ctx, a.Container, name, nil)
+	if err = azureError(name, err); IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (a *Azure) DeleteFileIf(ctx context.Context, name, etag string) error {
+	_, err := a.Client.DeleteBlob(ctx, a.Container, name, &azblob.DeleteBlobOptions{
+		AccessConditions: &blob.AccessConditions{ModifiedAccessConditions: &blob.ModifiedAccessConditions{
+			IfMatch: to.Ptr(azcore.ETag(quote(etag))),
+		}},
+	})
+	if IsNotExist(azureError(name, err)) {
+		return fmt.Errorf("%s: %w", name, ErrConditionFailed)
+	}
+	return azureError(name, err)
+}
+
+// copy starts a copy of source to key, and waits for the service to finish it.
+func (a *Azure) copy(ctx context.Context, key string, source Source, metadata map[string]string, conditions *blob.ModifiedAccessConditions) error {
+	container := source.Bucket
+	if container == "" {
+		container = a.Container
+	}
+
+	src := a.blob(container, source.Key)
+	if a.Policy != nil && metadata == nil {
+		// the metadata of the source is kept, with the policy added.
+		props, err := src.GetProperties(ctx, nil)
+		if err != nil {
+			return azureError(source.Key, err)
+		}
+		metadata = fromAzureMetadata(props.Metadata)
+	}
+
+	dst := a.blob(a.Container, key)
+	resp, err := dst.StartCopyFromURL(ctx, src.URL(), &blob.StartCopyFromURLOptions{
+		Metadata:         azureMetadata(a.Policy.apply(metadata)),
+		AccessConditions: &blob.AccessConditions{ModifiedAccessConditions: conditions},
+	})
+	if err != nil {
+		return azureError(key, err)
+	}
+
+	status := resp.CopyStatus
+	for status != nil && *status == blob.CopyStatusTypePending {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+
+		props, err := dst.GetProperties(ctx, nil)
+		if err != nil {
+			return azureError(key, err)
+		}
+		status = props.CopyStatus
+	}
+	if status != nil && *status != blob.CopyStatusTypeSuccess {
+		return fmt.Errorf("%s: copy is %s", key, *status)
+	}
+
+	// a copy has the headers of the source.
+	if a.Policy != nil {
+		if _, err := dst.SetHTTPHeaders(ctx, *a.headers(key), nil); err != nil {
+			return azureError(key, err)
+		}
+	}
+	return nil
+}
+
+func (a *Azure) CopyFile(ctx context.Context, key string, source Source, metadata map[string]string) error {
+	return a.copy(ctx, key, source, metadata, nil)
+}
+
+func (a *Azure) CopyFileIfAbsent(ctx context.Context, key string, source Source, metadata map[string]string) error {
+	err := a.copy(ctx, key, source, metadata, &blob.ModifiedAccessConditions{IfNoneMatch: to.Ptr(azcore.ETagAny)})
+	if IsConditionFailed(err) {
+		return ErrExist
+	}
+	return err
+}
+
+func (a *Azure) ExistFile(ctx context.Context, name string) (bool, error) {
+	_, err := a.StatFile(ctx, name)
+	return exist(err)
+}
+
+func (a *Azure) StatFile(ctx context.Context, name string) (Object, error) {
+	props, err := a.blob(a.Container, name).GetProperties(ctx, nil)
+	if err != nil {
+		return Object{}, azureError(name, err)
+	}
+
+	object := Object{
+		Key:      name,
+		ETag:     etag(props.ETag),
+		Metadata: fromAzureMetadata(props.Metadata),
+		Headers: Headers{
+			ContentType:  value(props.ContentType),
+			CacheControl: value(props.CacheControl),
+		},
+	}
+	if props.ContentLength != nil {
+		object.Size = *props.ContentLength
+	}
+	if props.LastModified != nil {
+		object.LastModified = *props.LastModified
+	}
+	return object, nil
+}
+
+// download reads a file from start to end when end is not negative. the file
+// must have the ETag, when it is given.
+func (a *Azure) download(ctx context.Context, name, etag string, start, end int64) (io.ReadCloser, error) {
+	options := &azblob.DownloadStreamOptions{}
+	if end >= 0 {
+		options.Range = blob.HTTPRange{Offset: start, Count: end - start + 1}
+	}
+	if etag != "" {
+		options.AccessConditions = &blob.AccessConditions{ModifiedAccessConditions: &blob.ModifiedAccessConditions{
+			IfMatch: to.Ptr(azcore.ETag(quote(etag))),
+		}}
+	}
+
+	resp, err := a.Client.DownloadStream(ctx, a.Container, name, options)
+	if err != nil {
+		return nil, azureError(name, err)
+	}
+	return resp.Body, nil
+}
+
+func (a *Azure) ReadFile(ctx context.Context, name string) ([]byte, error) {
+	b, _, err := a.GetFile(ctx, name)
+	return b, err
+}
+
+func (a *Azure) GetFile(ctx context.Context, name string) ([]byte, Object, error) {
+	resp, err := a.Client.DownloadStream(ctx, a.Container, name, nil)
+	if err != nil {
+		return nil, Object{}, azureError(name, err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, Object{}, err
+	}
+
+	object := Object{
+		Key:      name,
+		Size:     int64(len(b)),
+		ETag:     etag(resp.ETag),
+		Metadata: fromAzureMetadata(resp.Metadata),
+		Headers: Headers{
+			ContentType:  value(resp.ContentType),
+			CacheControl: value(resp.CacheControl),
+		},
+	}
+	if resp.LastModified != nil {
+		object.LastModified = *resp.LastModified
+	}
+	return b, object, nil
+}
+
+func (a *Azure) OpenFile(ctx context.Context, name string) (File, error) {
+	object, err := a.StatFile(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return newReaderAt(ctx, object, func(ctx context.Context, start, end int64) (io.ReadCloser, error) {
+		return a.download(ctx, name, object.ETag, start, end)
+	}), nil
+}
+
+func (a *Azure) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	return a.download(ctx, name, "", 0, -1)
+}
+
+func (a *Azure) findObjects(ctx context.Context, prefix string, fn func(key string) bool) (objects []Object, err error) {
+	pager := a.Client.NewListBlobsFlatPager(a.Container, &azblob.ListBlobsFlatOptions{
+		Prefix:  &prefix,
+		Include: azblob.ListBlobsInclude{Metadata: true},
+	})
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, azureError(prefix, err)
+		}
+
+		for _, item := range page.Segment.BlobItems {
+			if item.Name == nil || !fn(*item.Name) {
+				continue
+			}
+
+			object := Object{Key: *item.Name, Metadata: fromAzureMetadata(item.Metadata)}
+			if item.Properties != nil {
+				object.ETag = etag(item.Properties.ETag)
+				if item.Properties.ContentLength != nil {
+					object.Size = *item.Properties.ContentLength
+				}
+			}
+			objects = append(objects, object)
+		}
+	}
+	return
+}
+
+func (a *Azure) findKeys(ctx context.Context, prefix string, fn func(key string) bool) (findList []string, err error) {
+	objects, err := a.findObjects(ctx, prefix, fn)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, object := range objects {
+		findList = append(findList, object.Key)
+	}
+	return
+}
+
+func (a *Azure) FindPackages(ctx context.Context, root string) (findList []string, err error) {
+	return a.findKeys(ctx, filepath.Join(root, "dists"), isPackages)
+}
+
+func (a *Azure) FindFiles(ctx context.Context, root string) (findList []string, err error) {
+	return a.findKeys(ctx, root, func(string) bool { return true })
+}
+
+func (a *Azure) FindDeb(ctx context.Context, root string) (findList []string, err error) {
+	return a.findKeys(ctx, filepath.Join(root, "pool"), isDeb)
+}
+
+func (a *Azure) ListDeb(ctx context.Context, root string) (objects []Object, err error) {
+	return a.findObjects(ctx, filepath.Join(root, "pool"), isDeb)
+}
+
+func (a *Azure) FindMetadata(ctx context.Context, root string) (findList []string, err error) {
+	return a.findKeys(ctx, filepath.Join(root, "pool"), isMetadata)
+}
@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+// the well-known account of Azurite.
+const azuriteAccountKey = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+
+func TestAzure(t *testing.T) {
+	testcontainers.SkipIfProviderIsNotHealthy(t)
+	ctx := t.Context()
+
+	container, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: testcontainers.ContainerRequest{
+			Image:        "mcr.microsoft.com/azure-storage/azurite:3.34.0",
+			Cmd:          []string{"azurite-blob", "--blobHost", "0.0.0.0", "--skipApiVersionCheck"},
+			ExposedPorts: []string{"10000/tcp"},
+			WaitingFor:   wait.ForListeningPort("10000/tcp"),
+		},
+		Started: true,
+	})
+	testcontainers.CleanupContainer(t, container)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	endpoint, err := container.PortEndpoint(ctx, "10000/tcp", "http")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := azblob.NewClientFromConnectionString("DefaultEndpointsProtocol=http;AccountName=devstoreaccount1;AccountKey="+azuriteAccountKey+";BlobEndpoint="+endpoint+"/devstoreaccount1;", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.CreateContainer(ctx, "repository", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	testImpl(t, &Azure{Client: client, Container: "repository"})
+}
@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/cenkalti/backoff/v5"
+)
+
+const (
+	// CopyObject copies up to 5 GiB, and is slow for large files.
+	DefaultCopyThreshold = 256 << 20
+	DefaultCopyPartSize  = 64 << 20
+
+	maxCopyParts    = 10000
+	copyConcurrency = 4
+	copyPartTries   = 5
+)
+
+func copySource(source Source) *string {
+	return aws.String(fmt.Sprintf("%v/%v", source.Bucket, source.Key))
+}
+
+// sourceObject returns the source as it was read, or states it.
+func (s *S3) sourceObject(ctx context.Context, source Source) (Object, error) {
+	if source.Object != nil {
+		return *source.Object, nil
+	}
+
+	result, err := s.S3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(source.Bucket),
+		Key:    aws.String(source.Key),
+	})
+	if err != nil {
+		return Object{}, s3Error(err)
+	}
+	return headObject(source.Key, result), nil
+}
+
+// copyParts copies src in parts with UploadPartCopy, and retries each part
+// unless it is refused. The metadata of src is kept when metadata is nil, and
+// each part is checked with SHA-256. When ifAbsent, the upload is completed
+// only if key does not exist.
+func (s *S3) copyParts(ctx context.Context, key string, source Source, src Object, metadata map[string]string, ifAbsent bool) error {
+	if metadata == nil {
+		metadata = src.Metadata
+	}
+	headers, options := s.Policy.Headers(key), s.Policy.OptionsOf(key)
+	upload, err := s.S3Client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:               aws.String(s.BucketName),
+		Key:                  aws.String(key),
+		Metadata:             s.Policy.apply(metadata),
+		ContentType:          optional(headers.ContentType),
+		CacheControl:         optional(headers.CacheControl),
+		ServerSideEncryption: types.ServerSideEncryption(options.ServerSideEncryption),
+		SSEKMSKeyId:          optional(options.SSEKMSKeyID),
+		StorageClass:         types.StorageClass(options.StorageClass),
+		ChecksumAlgorithm:    types.ChecksumAlgorithmSha256,
+	})
+	if err != nil {
+		return err
+	}
+
+	abort := func() {
+		_, err := s.S3Client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(s.BucketName),
+			Key:      aws.String(key),
+			UploadId: upload.UploadId,
+		})
+		if err != nil {
+			fmt.Println("can not abort upload", err)
+		}
+	}
+
+	parts, err := s.copyPartsOf(ctx, key, source, src, upload.UploadId)
+	if err != nil {
+		abort()
+		return err
+	}
+
+	input := &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.BucketName),
+		Key:             aws.String(key),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	}
+	if ifAbsent {
+		input.IfNoneMatch = aws.String("*")
+	}
+
+	if _, err = s.S3Client.CompleteMultipartUpload(ctx, input); err != nil {
+		abort()
+		if ifAbsent && IsConditionFailed(err) {
+			return ErrExist
+		}
+		return err
+	}
+
+	return nil
+}
+
+// copyPartsOf copies the parts of source concurrently, from the version of
+// src.
+func (s *S3) copyPartsOf(ctx context.Context, key string, source Source, src Object, uploadID *string) ([]types.CompletedPart, error) {
+	size := src.Size
+	partSize := max(cmp.Or(s.CopyPartSize, DefaultCopyPartSize), (size+maxCopyParts-1)/maxCopyParts)
+	count := max(1, (size+partSize-1)/partSize)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg    sync.WaitGroup
+		sem   = make(chan struct{}, copyConcurrency)
+		parts = make([]types.CompletedPart, count)
+		errs  = make([]error, count)
+	)
+	for i := range count {
+		// a single part is copied whole, even when the source is empty.
+		var copyRange *string
+		if count > 1 {
+			copyRange = aws.String(fmt.Sprintf("bytes=%d-%d", i*partSize, min((i+1)*partSize, size)-1))
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			parts[i], errs[i] = s.copyPart(ctx, key, source, src.ETag, uploadID, int32(i+1), copyRange)
+			if errs[i] != nil {
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// the parts canceled after another has failed are not the cause.
+	var err error
+	for _, e := range errs {
+		if e != nil && (err == nil || errors.Is(err, context.Canceled)) {
+			err = e
+		}
+	}
+	return parts, err
+}
+
+func (s *S3) copyPart(ctx context.Context, key string, source Source, etag string, uploadID *string, number int32, copyRange *string) (types.CompletedPart, error) {
+	return backoff.Retry(ctx, func() (types.CompletedPart, error) {
+		output, err := s.S3Client.UploadPartCopy(ctx, &s3.UploadPartCopyInput{
+			Bucket:            aws.String(s.BucketName),
+			Key:               aws.String(key),
+			CopySource:        copySource(source),
+			CopySourceIfMatch: aws.String(quote(etag)),
+			CopySourceRange:   copyRange,
+			PartNumber:        aws.Int32(number),
+			UploadId:          uploadID,
+		})
+		if isClientError(err) {
+			return types.CompletedPart{}, backoff.Permanent(err)
+		}
+		if err != nil {
+			fmt.Println("retry part", number, err)
+			return types.CompletedPart{}, err
+		}
+
+		return types.CompletedPart{
+			ETag:           output.CopyPartResult.ETag,
+			ChecksumSHA256: output.CopyPartResult.ChecksumSHA256,
+			PartNumber:     aws.Int32(number),
+		}, nil
+	}, backoff.WithBackOff(backoff.NewExponentialBackOff()), backoff.WithMaxTries(copyPartTries))
+}
+
+// isClientError reports whether err is a 4xx response, which fails again.
+func isClientError(err error) bool {
+	var re *awshttp.ResponseError
+	return errors.As(err, &re) && re.HTTPStatusCode() >= 400 && re.HTTPStatusCode() < 500
+}
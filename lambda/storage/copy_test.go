@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func TestS3CopyParts(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		ranges   []string
+		failed   bool
+		heads    int
+		refused  = map[string]int{}
+		metadata string
+		complete struct {
+			Part []struct {
+				PartNumber     int
+				ETag           string
+				ChecksumSHA256 string
+			}
+		}
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		q := r.URL.Query()
+		switch {
+		case r.Method == http.MethodHead:
+			heads++
+			w.Header().Set("Content-Length", "10")
+			w.Header().Set("ETag", `"src"`)
+			w.Header().Set("X-Amz-Meta-Sum", "abc")
+		case r.Method == http.MethodPost && q.Has("uploads"):
+			metadata = r.Header.Get("X-Amz-Meta-Sum")
+			fmt.Fprint(w, `<InitiateMultipartUploadResult><UploadId>1</UploadId></InitiateMultipartUploadResult>`)
+		case r.Method == http.MethodPut && q.Has("partNumber"):
+			// the source is changed since it was read.
+			if r.Header.Get("X-Amz-Copy-Source-If-Match") != `"src"` {
+				refused[q.Get("partNumber")]++
+				w.WriteHeader(http.StatusPreconditionFailed)
+				fmt.Fprint(w, `<Error><Code>PreconditionFailed</Code></Error>`)
+				return
+			}
+			// the second part fails once.
+			if q.Get("partNumber") == "2" && !failed {
+				failed = true
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprint(w, `<Error><Code>InternalError</Code></Error>`)
+				return
+			}
+			ranges = append(ranges, r.Header.Get("X-Amz-Copy-Source-Range"))
+			fmt.Fprintf(w, `<CopyPartResult><ETag>"%s"</ETag><ChecksumSHA256>sum%[1]s</ChecksumSHA256></CopyPartResult>`, q.Get("partNumber"))
+		case r.Method == http.MethodDelete && q.Has("uploadId"):
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodPost && q.Has("uploadId"):
+			b, _ := io.ReadAll(r.Body)
+			if err := xml.Unmarshal(b, &complete); err != nil {
+				t.Error(err)
+			}
+			fmt.Fprint(w, `<CompleteMultipartUploadResult><ETag>"dst"</ETag></CompleteMultipartUploadResult>`)
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	fs := &S3{
+		S3Client: s3.New(s3.Options{
+			Region:           "us-east-1",
+			BaseEndpoint:     aws.String(srv.URL),
+			UsePathStyle:     true,
+			Credentials:      aws.AnonymousCredentials{},
+			RetryMaxAttempts: 1,
+		}),
+		BucketName:    "repository",
+		CopyThreshold: 4,
+		CopyPartSize:  4,
+	}
+	if err := fs.CopyFile(t.Context(), "debian/pool/main/m/mkr/mkr.deb", Source{Bucket: "incoming", Key: "mkr.deb"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	slices.Sort(ranges)
+	if !failed || !slices.Equal(ranges, []string{"bytes=0-3", "bytes=4-7", "bytes=8-9"}) {
+		t.Fatal(failed, ranges)
+	}
+	if metadata != "abc" {
+		t.Fatalf("metadata is not kept: %q", metadata)
+	}
+	if len(complete.Part) != 3 {
+		t.Fatalf("unexpected parts: %+v", complete.Part)
+	}
+	for i, part := range complete.Part {
+		if part.PartNumber != i+1 || part.ChecksumSHA256 != fmt.Sprintf("sum%d", i+1) {
+			t.Errorf("unexpected part: %+v", part)
+		}
+	}
+
+	// a refused part is not retried, and the source which was read is not
+	// stated by the client of the repository.
+	heads = 0
+	err := fs.CopyFile(t.Context(), "debian/pool/main/m/mkr/mkr.deb", Source{Bucket: "incoming", Key: "mkr.deb", Object: &Object{Size: 10, ETag: "old"}}, nil)
+	if err == nil || len(refused) == 0 || heads != 0 {
+		t.Fatal(refused, heads, err)
+	}
+	for _, n := range refused {
+		if n != 1 {
+			t.Fatal("refused part is retried", refused)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+
+	gcs "cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+)
+
+// GCS stores the files in a bucket of Google Cloud Storage. The ETag of a
+// file is its generation, which the conditions use.
+type GCS struct {
+	Client *gcs.Client
+	Bucket string
+
+	// Policy sets the headers of the files written, nil for none.
+	Policy *Policy
+}
+
+var _ Impl = (*GCS)(nil)
+
+func gcsObject(attrs *gcs.ObjectAttrs) Object {
+	return Object{
+		Key:          attrs.Name,
+		Size:         attrs.Size,
+		ETag:         strconv.FormatInt(attrs.Generation, 10),
+		Metadata:     attrs.Metadata,
+		LastModified: attrs.Updated,
+		Headers:      Headers{ContentType: attrs.ContentType, CacheControl: attrs.CacheControl},
+	}
+}
+
+// gcsError wraps the errors of a missing file and of a failed condition.
+func gcsError(err error) error {
+	var apiErr *googleapi.Error
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, gcs.ErrObjectNotExist):
+		return fmt.Errorf("%w: %w", ErrNotExist, err)
+	case errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound:
+		return fmt.Errorf("%w: %w", ErrNotExist, err)
+	case errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed:
+		return fmt.Errorf("%w: %w", ErrConditionFailed, err)
+	}
+	return err
+}
+
+// bucket retries every request on the transient errors, the unconditional
+// writes too, as the same data is written again.
+func (g *GCS) bucket(name string) *gcs.BucketHandle {
+	if name == "" {
+		name = g.Bucket
+	}
+	return g.Client.Bucket(name).Retryer(gcs.WithPolicy(gcs.RetryAlways))
+}
+
+// attrs are the attributes of a file written with metadata, with the headers
+// of Policy.
+func (g *GCS) attrs(name string, metadata map[string]string) gcs.ObjectAttrs {
+	headers := g.Policy.Headers(name)
+	return gcs.ObjectAttrs{
+		Metadata:     g.Policy.apply(metadata),
+		ContentType:  headers.ContentType,
+		CacheControl: headers.CacheControl,
+	}
+}
+
+// upload writes a file with its metadata, and returns its generation.
+func (g *GCS) upload(ctx context.Context, name string, data []byte, metadata map[string]string, cond *gcs.Conditions) (string, error) {
+	// the file is not written when ctx is canceled before Close.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	o := g.bucket("").Object(name)
+	if cond != nil {
+		o = o.If(*cond)
+	}
+	w := o.NewWriter(ctx)
+	attrs := g.attrs(name, metadata)
+	w.Metadata, w.ContentType, w.CacheControl = attrs.Metadata, attrs.ContentType, attrs.CacheControl
+
+	if _, err := w.Write(data); err != nil {
+		return "", gcsError(err)
+	}
+	if err := w.Close(); err != nil {
+		return "", gcsError(err)
+	}
+	return strconv.FormatInt(w.Attrs().Generation, 10), nil
+}
+
+func (g *GCS) WriteFile(ctx context.Context, name string, data []byte, metadata map[string]string) error {
+	_, err := g.upload(ctx, name, data, metadata, nil)
+	return err
+}
+
+func (g *GCS) WriteFileIf(ctx context.Context, name string, data []byte, metadata map[string]string, cond Condition) (string, error) {
+	var conds *gcs.Conditions
+	if cond.IfNoneMatch {
+		conds = &gcs.Conditions{DoesNotExist: true}
+	}
+	if cond.IfMatch != "" {
+		generation, err := strconv.ParseInt(cond.IfMatch, 10, 64)
+		if err != nil {
+			return "", err
+		}
+		conds = &gcs.Conditions{GenerationMatch: generation}
+	}
+	return g.upload(ctx, name, data, metadata, conds)
+}
+
+func (g *GCS) DeleteFile(ctx context.Context, name string) error {
+	err := gcsError(g.bucket("").Object(name).Delete(ctx))
+	if IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (g *GCS) DeleteFileIf(ctx context.Context, name, etag string) error {
+	generation, err := strconv.ParseInt(etag, 10, 64)
+	if err != nil {
+		return err
+	}
+	return gcsError(g.bucket("").Object(name).If(gcs.Conditions{GenerationMatch: generation}).Delete(ctx))
+}
+
+// rewrite copies source to key, in as many requests as the service needs.
+func (g *GCS) rewrite(ctx context.Context, key string, source Source, metadata map[string]string, cond *gcs.Conditions) error {
+	src := g.bucket(source.Bucket).Object(source.Key)
+	if g.Policy != nil && metadata == nil {
+		// the metadata of the source is kept, with the headers replaced.
+		attrs, err := src.Attrs(ctx)
+		if err != nil {
+			return gcsError(err)
+		}
+		metadata = attrs.Metadata
+	}
+
+	dst := g.bucket("").Object(key)
+	if cond != nil {
+		dst = dst.If(*cond)
+	}
+	copier := dst.CopierFrom(src)
+	if metadata != nil || g.Policy != nil {
+		copier.ObjectAttrs = g.attrs(key, metadata)
+	}
+	_, err := copier.Run(ctx)
+	return gcsError(err)
+}
+
+func (g *GCS) CopyFile(ctx context.Context, key string, source Source, metadata map[string]string) error {
+	return g.rewrite(ctx, key, source, metadata, nil)
+}
+
+func (g *GCS) CopyFileIfAbsent(ctx context.Context, key string, source Source, metadata map[string]string) error {
+	err := g.rewrite(ctx, key, source, metadata, &gcs.Conditions{DoesNotExist: true})
+	if IsConditionFailed(err) {
+		return ErrExist
+	}
+	return err
+}
+
+func (g *GCS) ExistFile(ctx context.Context, name string) (bool, error) {
+	_, err := g.StatFile(ctx, name)
+	return exist(err)
+}
+
+func (g *GCS) StatFile(ctx context.Context, name string) (Object, error) {
+	attrs, err := g.bucket("").Object(name).Attrs(ctx)
+	if err != nil {
+		return Object{}, gcsError(err)
+	}
+	return gcsObject(attrs), nil
+}
+
+// media reads the generation of a file, from start to end when end is not
+// negative.
+func (g *GCS) media(ctx context.Context, name, generation string, start, end int64) (io.ReadCloser, error) {
+	o := g.bucket("").Object(name)
+	if generation != "" {
+		gen, err := strconv.ParseInt(generation, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		o = o.Generation(gen)
+	}
+
+	length := int64(-1)
+	if end >= 0 {
+		length = end - start + 1
+	}
+	r, err := o.NewRangeReader(ctx, start, length)
+	if err != nil {
+		return nil, gcsError(err)
+	}
+	return r, nil
+}
+
+func (g *GCS) ReadFile(ctx context.Context, name string) ([]byte, error) {
+	b, _, err := g.GetFile(ctx, name)
+	return b, err
+}
+
+func (g *GCS) GetFile(ctx context.Context, name string) ([]byte, Object, error) {
+	object, err := g.StatFile(ctx, name)
+	if err != nil {
+		return nil, Object{}, err
+	}
+
+	// the generation which was stated is read, even when it is replaced.
+	body, err := g.media(ctx, name, object.ETag, 0, -1)
+	if err != nil {
+		return nil, Object{}, err
+	}
+	defer body.Close()
+
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return nil, Object{}, err
+	}
+	return b, object, nil
+}
+
+func (g *GCS) OpenFile(ctx context.Context, name string) (File, error) {
+	object, err := g.StatFile(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return newReaderAt(ctx, object, func(ctx context.Context, start, end int64) (io.ReadCloser, error) {
+		return g.media(ctx, name, object.ETag, start, end)
+	}), nil
+}
+
+func (g *GCS) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	return g.media(ctx, name, "", 0, -1)
+}
+
+func (g *GCS) findObjects(ctx context.Context, prefix string, fn func(key string) bool) (objects []Object, err error) {
+	it := g.bucket("").Objects(ctx, &gcs.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			return objects, nil
+		}
+		if err != nil {
+			return nil, gcsError(err)
+		}
+
+		if fn(attrs.Name) {
+			objects = append(objects, gcsObject(attrs))
+		}
+	}
+}
+
+func (g *GCS) findKeys(ctx context.Context, prefix string, fn func(key string) bool) (findList []string, err error) {
+	objects, err := g.findObjects(ctx, prefix, fn)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, object := range objects {
+		findList = append(findList, object.Key)
+	}
+	return
+}
+
+func (g *GCS) FindPackages(ctx context.Context, root string) (findList []string, err error) {
+	return g.findKeys(ctx, filepath.Join(root, "dists"), isPackages)
+}
+
+func (g *GCS) FindFiles(ctx context.Context, root string) (findList []string, err error) {
+	return g.findKeys(ctx, root, func(string) bool { return true })
+}
+
+func (g *GCS) FindDeb(ctx context.Context, root string) (findList []string, err error) {
+	return g.findKeys(ctx, filepath.Join(root, "pool"), isDeb)
+}
+
+func (g *GCS) ListDeb(ctx context.Context, root string) (objects []Object, err error) {
+	return g.findObjects(ctx, filepath.Join(root, "pool"), isDeb)
+}
+
+func (g *GCS) FindMetadata(ctx context.Context, root string) (findList []string, err error) {
+	return g.findKeys(ctx, filepath.Join(root, "pool"), isMetadata)
+}
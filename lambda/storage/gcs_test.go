@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	gcs "cloud.google.com/go/storage"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+func TestGCS(t *testing.T) {
+	testcontainers.SkipIfProviderIsNotHealthy(t)
+	ctx := t.Context()
+
+	container, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: testcontainers.ContainerRequest{
+			Image:        "fsouza/fake-gcs-server:1.52",
+			Cmd:          []string{"-scheme", "http", "-port", "4443"},
+			ExposedPorts: []string{"4443/tcp"},
+			WaitingFor:   wait.ForHTTP("/storage/v1/b").WithPort("4443/tcp"),
+		},
+		Started: true,
+	})
+	testcontainers.CleanupContainer(t, container)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	endpoint, err := container.PortEndpoint(ctx, "4443/tcp", "http")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Post(endpoint+"/storage/v1/b", "application/json", strings.NewReader(`{"name":"repository"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("can not create bucket: %s", resp.Status)
+	}
+
+	t.Setenv("STORAGE_EMULATOR_HOST", strings.TrimPrefix(endpoint, "http://"))
+	client, err := gcs.NewClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	testImpl(t, &GCS{Client: client, Bucket: "repository"})
+}
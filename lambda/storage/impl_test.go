@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"io"
+	"slices"
+	"testing"
+)
+
+func exists(t *testing.T, fs Impl, name string) bool {
+	t.Helper()
+	exist, err := fs.ExistFile(t.Context(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return exist
+}
+
+// testImpl checks the behavior which the backends share, on an empty bucket.
+func testImpl(t *testing.T, fs Impl) {
+	t.Helper()
+	ctx := t.Context()
+
+	const packages = "debian/dists/stable/main/binary-amd64/Packages"
+	const deb = "debian/pool/main/m/mkr/mkr.deb"
+
+	if _, err := fs.StatFile(ctx, packages); !IsNotExist(err) {
+		t.Fatal("missing file is stated", err)
+	}
+	if _, _, err := fs.GetFile(ctx, packages); !IsNotExist(err) {
+		t.Fatal("missing file is read", err)
+	}
+
+	etag, err := fs.WriteFileIf(ctx, packages, []byte("Package: mkr\n"), nil, Condition{IfNoneMatch: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.WriteFileIf(ctx, packages, []byte("Package: mkr\n"), nil, Condition{IfNoneMatch: true}); !IsConditionFailed(err) {
+		t.Fatal("file is overwritten", err)
+	}
+
+	b, object, err := fs.GetFile(ctx, packages)
+	if err != nil || string(b) != "Package: mkr\n" || object.ETag != etag {
+		t.Fatal(string(b), object, err)
+	}
+
+	newer, err := fs.WriteFileIf(ctx, packages, []byte("Package: mackerel-agent\n"), nil, Condition{IfMatch: etag})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.WriteFileIf(ctx, packages, []byte("Package: mkr\n"), nil, Condition{IfMatch: etag}); !IsConditionFailed(err) {
+		t.Fatal("file is written with a stale ETag", err)
+	}
+	if err := fs.DeleteFileIf(ctx, packages, etag); !IsConditionFailed(err) {
+		t.Fatal("file is deleted with a stale ETag", err)
+	}
+
+	if err := fs.WriteFile(ctx, "incoming/mkr.deb", []byte("deb"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.CopyFileIfAbsent(ctx, deb, Source{Key: "incoming/mkr.deb"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.CopyFileIfAbsent(ctx, deb, Source{Key: "incoming/mkr.deb"}, nil); err != ErrExist {
+		t.Fatal("file is copied twice", err)
+	}
+
+	f, err := fs.OpenFile(ctx, deb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if f.Size() != 3 {
+		t.Fatalf("unexpected object: %+v", f.Object())
+	}
+	b, err = io.ReadAll(io.NewSectionReader(f, 1, 2))
+	if err != nil || string(b) != "eb" {
+		t.Fatal(string(b), err)
+	}
+
+	list, err := fs.FindPackages(ctx, "debian")
+	if err != nil || !slices.Equal(list, []string{packages}) {
+		t.Fatal(list, err)
+	}
+	debs, err := fs.FindDeb(ctx, "debian")
+	if err != nil || !slices.Equal(debs, []string{deb}) {
+		t.Fatal(debs, err)
+	}
+	// the whole bucket.
+	files, err := fs.FindFiles(ctx, "")
+	if err != nil || !slices.Equal(files, []string{packages, deb, "incoming/mkr.deb"}) {
+		t.Fatal(files, err)
+	}
+
+	if err := fs.DeleteFileIf(ctx, packages, newer); err != nil {
+		t.Fatal(err)
+	}
+	if exists(t, fs, packages) {
+		t.Fatal("file is not deleted")
+	}
+	if err := fs.DeleteFile(ctx, packages); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemory(t *testing.T) {
+	testImpl(t, NewMemory())
+}
+
+func TestLocalImpl(t *testing.T) {
+	testImpl(t, &Local{Dir: t.TempDir()})
+}
@@ -0,0 +1,321 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Local stores the files in the directory Dir. The bucket of a Source is a
+// directory, Dir when it is empty. The metadata of the files is not kept, so
+// the digests are computed again when they are needed. The conditional writes
+// are serialized in the process only.
+type Local struct {
+	Dir string
+
+	mu sync.Mutex
+}
+
+var _ Impl = (*Local)(nil)
+
+func (l *Local) path(name string) string {
+	return filepath.Join(l.Dir, filepath.FromSlash(name))
+}
+
+func (l *Local) object(name string, info fs.FileInfo) Object {
+	return Object{
+		Key:  name,
+		Size: info.Size(),
+		// changes when the file is written again, as the file is replaced.
+		ETag: fmt.Sprintf("%x-%x", info.ModTime().UnixNano(), info.Size()),
+	}
+}
+
+// createTemp writes r to a temporary file next to name, and returns its path.
+func (l *Local) createTemp(name string, r io.Reader) (string, error) {
+	dest := l.path(name)
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return "", err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(dest), "."+filepath.Base(dest)+".tmp*")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = io.Copy(f, r)
+	if errC := f.Close(); err == nil {
+		err = errC
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0o644)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// writeFile replaces name at once, readers see the old or the new content.
+func (l *Local) writeFile(name string, r io.Reader) error {
+	tmp, err := l.createTemp(name, r)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, l.path(name)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func (l *Local) WriteFile(ctx context.Context, name string, data []byte, metadata map[string]string) error {
+	return l.writeFile(name, bytes.NewReader(data))
+}
+
+func (l *Local) DeleteFile(ctx context.Context, name string) error {
+	err := os.Remove(l.path(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (l *Local) GetFile(ctx context.Context, name string) ([]byte, Object, error) {
+	f, err := os.Open(l.path(name))
+	if err != nil {
+		return nil, Object{}, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, Object{}, err
+	}
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return nil, Object{}, err
+	}
+	return b, l.object(name, info), nil
+}
+
+// match fails unless the ETag of name is etag.
+func (l *Local) match(name, etag string) error {
+	object, err := l.StatFile(context.Background(), name)
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && object.ETag != etag) {
+		return fmt.Errorf("%s: %w", name, ErrConditionFailed)
+	}
+	return err
+}
+
+func (l *Local) WriteFileIf(ctx context.Context, name string, data []byte, metadata map[string]string, cond Condition) (string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if cond.IfMatch != "" {
+		if err := l.match(name, cond.IfMatch); err != nil {
+			return "", err
+		}
+	}
+
+	tmp, err := l.createTemp(name, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp)
+
+	if cond.IfNoneMatch {
+		err = os.Link(tmp, l.path(name))
+		if errors.Is(err, fs.ErrExist) {
+			err = fmt.Errorf("%s: %w", name, ErrConditionFailed)
+		}
+	} else {
+		err = os.Rename(tmp, l.path(name))
+	}
+	if err != nil {
+		return "", err
+	}
+
+	object, err := l.StatFile(ctx, name)
+	return object.ETag, err
+}
+
+func (l *Local) DeleteFileIf(ctx context.Context, name, etag string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.match(name, etag); err != nil {
+		return err
+	}
+	return os.Remove(l.path(name))
+}
+
+func (l *Local) source(source Source) string {
+	dir := source.Bucket
+	if dir == "" {
+		dir = l.Dir
+	}
+	return filepath.Join(dir, filepath.FromSlash(source.Key))
+}
+
+func (l *Local) CopyFile(ctx context.Context, key string, source Source, metadata map[string]string) error {
+	f, err := os.Open(l.source(source))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return l.writeFile(key, f)
+}
+
+func (l *Local) CopyFileIfAbsent(ctx context.Context, key string, source Source, metadata map[string]string) error {
+	f, err := os.Open(l.source(source))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tmp, err := l.createTemp(key, f)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	// link fails when the file exists.
+	err = os.Link(tmp, l.path(key))
+	if errors.Is(err, fs.ErrExist) {
+		return ErrExist
+	}
+	return err
+}
+
+func (l *Local) ExistFile(ctx context.Context, name string) (bool, error) {
+	info, err := os.Stat(l.path(name))
+	if err != nil {
+		return exist(err)
+	}
+	return info.Mode().IsRegular(), nil
+}
+
+func (l *Local) StatFile(ctx context.Context, name string) (Object, error) {
+	info, err := os.Stat(l.path(name))
+	if err != nil {
+		return Object{}, err
+	}
+	// a directory is not a file, as in the buckets.
+	if info.IsDir() {
+		return Object{}, &fs.PathError{Op: "stat", Path: l.path(name), Err: ErrNotExist}
+	}
+	return l.object(name, info), nil
+}
+
+func (l *Local) ReadFile(ctx context.Context, name string) ([]byte, error) {
+	return os.ReadFile(l.path(name))
+}
+
+type localFile struct {
+	*os.File
+	object Object
+}
+
+func (f *localFile) Size() int64 {
+	return f.object.Size
+}
+
+func (f *localFile) Object() Object {
+	return f.object
+}
+
+func (l *Local) OpenFile(ctx context.Context, name string) (File, error) {
+	f, err := os.Open(l.path(name))
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		f.Close()
+		return nil, &fs.PathError{Op: "open", Path: l.path(name), Err: ErrNotExist}
+	}
+	return &localFile{File: f, object: l.object(name, info)}, nil
+}
+
+func (l *Local) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	return os.Open(l.path(name))
+}
+
+func (l *Local) findObjects(prefix string, fn func(key string) bool) (objects []Object, err error) {
+	err = filepath.WalkDir(l.path(prefix), func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// temporary files.
+		if !d.Type().IsRegular() || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(l.Dir, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !fn(key) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, l.object(key, info))
+		return nil
+	})
+	return
+}
+
+func (l *Local) findKeys(prefix string, fn func(key string) bool) (findList []string, err error) {
+	objects, err := l.findObjects(prefix, fn)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, object := range objects {
+		findList = append(findList, object.Key)
+	}
+	return
+}
+
+func (l *Local) FindPackages(ctx context.Context, root string) (findList []string, err error) {
+	return l.findKeys(filepath.Join(root, "dists"), isPackages)
+}
+
+func (l *Local) FindFiles(ctx context.Context, root string) (findList []string, err error) {
+	return l.findKeys(root, func(string) bool { return true })
+}
+
+func (l *Local) FindDeb(ctx context.Context, root string) (findList []string, err error) {
+	return l.findKeys(filepath.Join(root, "pool"), isDeb)
+}
+
+func (l *Local) ListDeb(ctx context.Context, root string) (objects []Object, err error) {
+	return l.findObjects(filepath.Join(root, "pool"), isDeb)
+}
+
+func (l *Local) FindMetadata(ctx context.Context, root string) (findList []string, err error) {
+	return l.findKeys(filepath.Join(root, "pool"), isMetadata)
+}
@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestLocal(t *testing.T) {
+	ctx := t.Context()
+	l := &Local{Dir: t.TempDir()}
+
+	if err := l.WriteFile(ctx, "debian/dists/stable/main/binary-amd64/Packages", []byte("Package: mkr\n"), nil); err != nil {
+		t.Fatal(err)
+	}
+	b, err := l.ReadFile(ctx, "debian/dists/stable/main/binary-amd64/Packages")
+	if err != nil || string(b) != "Package: mkr\n" {
+		t.Fatal(string(b), err)
+	}
+
+	incoming := t.TempDir()
+	if err := os.WriteFile(filepath.Join(incoming, "mkr.deb"), []byte("deb"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	source := Source{Bucket: incoming, Key: "mkr.deb"}
+
+	if err := l.CopyFileIfAbsent(ctx, "debian/pool/main/m/mkr/mkr.deb", source, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.CopyFileIfAbsent(ctx, "debian/pool/main/m/mkr/mkr.deb", source, nil); !errors.Is(err, ErrExist) {
+		t.Fatal("file is copied twice", err)
+	}
+
+	f, err := l.OpenFile(ctx, "debian/pool/main/m/mkr/mkr.deb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if f.Size() != 3 || f.Object().ETag == "" {
+		t.Fatalf("unexpected object: %+v", f.Object())
+	}
+	b, err = io.ReadAll(io.NewSectionReader(f, 1, 2))
+	if err != nil || string(b) != "eb" {
+		t.Fatal(string(b), err)
+	}
+
+	debs, err := l.FindDeb(ctx, "debian")
+	if err != nil || !slices.Equal(debs, []string{"debian/pool/main/m/mkr/mkr.deb"}) {
+		t.Fatal(debs, err)
+	}
+	list, err := l.FindPackages(ctx, "debian")
+	if err != nil || !slices.Equal(list, []string{"debian/dists/stable/main/binary-amd64/Packages"}) {
+		t.Fatal(list, err)
+	}
+	if list, err := l.FindFiles(ctx, "missing"); err != nil || len(list) != 0 {
+		t.Fatal(list, err)
+	}
+
+	if err := l.DeleteFile(ctx, "debian/pool/main/m/mkr/mkr.deb"); err != nil {
+		t.Fatal(err)
+	}
+	if exists(t, l, "debian/pool/main/m/mkr/mkr.deb") {
+		t.Fatal("file is not deleted")
+	}
+	if err := l.DeleteFile(ctx, "debian/pool/main/m/mkr/mkr.deb"); err != nil {
+		t.Fatal(err)
+	}
+}
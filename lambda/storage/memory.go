@@ -0,0 +1,255 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+type memoryFile struct {
+	data     []byte
+	metadata map[string]string
+	etag     string
+	headers  Headers
+}
+
+// Memory keeps the files in memory, for tests. The bucket of a Source is
+// looked up in Buckets, and is the Memory itself when it is missing.
+type Memory struct {
+	Buckets map[string]*Memory
+	// Policy sets the headers of the files written, nil for none.
+	Policy *Policy
+
+	mu    sync.Mutex
+	files map[string]memoryFile
+}
+
+var _ Impl = (*Memory)(nil)
+
+func NewMemory() *Memory {
+	return &Memory{
+		Buckets: make(map[string]*Memory),
+		files:   make(map[string]memoryFile),
+	}
+}
+
+func (m *Memory) get(name string) (memoryFile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.files[name]
+	if !ok {
+		return f, fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+	}
+	return f, nil
+}
+
+func (m *Memory) newFile(name string, data []byte, metadata map[string]string) memoryFile {
+	sum := md5.Sum(data)
+	return memoryFile{
+		data:     bytes.Clone(data),
+		metadata: maps.Clone(m.Policy.apply(metadata)),
+		etag:     hex.EncodeToString(sum[:]),
+		headers:  m.Policy.Headers(name),
+	}
+}
+
+func (m *Memory) put(name string, data []byte, metadata map[string]string, ifAbsent bool) error {
+	f := m.newFile(name, data, metadata)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.files[name]; ok && ifAbsent {
+		return ErrExist
+	}
+	m.files[name] = f
+	return nil
+}
+
+func (m *Memory) WriteFile(ctx context.Context, name string, data []byte, metadata map[string]string) error {
+	return m.put(name, data, metadata, false)
+}
+
+func (m *Memory) DeleteFile(ctx context.Context, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.files, name)
+	return nil
+}
+
+func (m *Memory) GetFile(ctx context.Context, name string) ([]byte, Object, error) {
+	f, err := m.get(name)
+	if err != nil {
+		return nil, Object{}, err
+	}
+	return bytes.Clone(f.data), m.object(name, f), nil
+}
+
+func (m *Memory) WriteFileIf(ctx context.Context, name string, data []byte, metadata map[string]string, cond Condition) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	current, exists := m.files[name]
+	if (cond.IfNoneMatch && exists) || (cond.IfMatch != "" && (!exists || current.etag != cond.IfMatch)) {
+		return "", fmt.Errorf("%s: %w", name, ErrConditionFailed)
+	}
+
+	m.files[name] = m.newFile(name, data, metadata)
+	return m.files[name].etag, nil
+}
+
+func (m *Memory) DeleteFileIf(ctx context.Context, name, etag string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if current, ok := m.files[name]; !ok || current.etag != etag {
+		return fmt.Errorf("%s: %w", name, ErrConditionFailed)
+	}
+	delete(m.files, name)
+	return nil
+}
+
+func (m *Memory) source(source Source) (memoryFile, error) {
+	bucket, ok := m.Buckets[source.Bucket]
+	if !ok {
+		bucket = m
+	}
+	return bucket.get(source.Key)
+}
+
+func (m *Memory) CopyFile(ctx context.Context, key string, source Source, metadata map[string]string) error {
+	f, err := m.source(source)
+	if err != nil {
+		return err
+	}
+	if metadata == nil {
+		metadata = f.metadata
+	}
+	return m.put(key, f.data, metadata, false)
+}
+
+func (m *Memory) CopyFileIfAbsent(ctx context.Context, key string, source Source, metadata map[string]string) error {
+	f, err := m.source(source)
+	if err != nil {
+		return err
+	}
+	if metadata == nil {
+		metadata = f.metadata
+	}
+	return m.put(key, f.data, metadata, true)
+}
+
+func (m *Memory) ExistFile(ctx context.Context, name string) (bool, error) {
+	_, err := m.get(name)
+	return exist(err)
+}
+
+func (m *Memory) object(name string, f memoryFile) Object {
+	return Object{
+		Key:      name,
+		Size:     int64(len(f.data)),
+		ETag:     f.etag,
+		Metadata: maps.Clone(f.metadata),
+		Headers:  f.headers,
+	}
+}
+
+func (m *Memory) StatFile(ctx context.Context, name string) (Object, error) {
+	f, err := m.get(name)
+	if err != nil {
+		return Object{}, err
+	}
+	return m.object(name, f), nil
+}
+
+func (m *Memory) ReadFile(ctx context.Context, name string) ([]byte, error) {
+	f, err := m.get(name)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Clone(f.data), nil
+}
+
+type memoryReader struct {
+	*bytes.Reader
+	object Object
+}
+
+func (r *memoryReader) Size() int64 {
+	return r.object.Size
+}
+
+func (r *memoryReader) Object() Object {
+	return r.object
+}
+
+func (r *memoryReader) Close() error {
+	return nil
+}
+
+func (m *Memory) OpenFile(ctx context.Context, name string) (File, error) {
+	f, err := m.get(name)
+	if err != nil {
+		return nil, err
+	}
+	return &memoryReader{Reader: bytes.NewReader(f.data), object: m.object(name, f)}, nil
+}
+
+func (m *Memory) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	f, err := m.get(name)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(f.data)), nil
+}
+
+func (m *Memory) findObjects(prefix string, fn func(key string) bool) (objects []Object) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// the whole bucket when empty.
+	if prefix != "" {
+		prefix += "/"
+	}
+	for _, name := range slices.Sorted(maps.Keys(m.files)) {
+		if strings.HasPrefix(name, prefix) && fn(name) {
+			objects = append(objects, m.object(name, m.files[name]))
+		}
+	}
+	return
+}
+
+func (m *Memory) findKeys(prefix string, fn func(key string) bool) (findList []string) {
+	for _, object := range m.findObjects(prefix, fn) {
+		findList = append(findList, object.Key)
+	}
+	return
+}
+
+func (m *Memory) FindPackages(ctx context.Context, root string) (findList []string, err error) {
+	return m.findKeys(filepath.Join(root, "dists"), isPackages), nil
+}
+
+func (m *Memory) FindFiles(ctx context.Context, root string) (findList []string, err error) {
+	return m.findKeys(root, func(string) bool { return true }), nil
+}
+
+func (m *Memory) FindDeb(ctx context.Context, root string) (findList []string, err error) {
+	return m.findKeys(filepath.Join(root, "pool"), isDeb), nil
+}
+
+func (m *Memory) ListDeb(ctx context.Context, root string) (objects []Object, err error) {
+	return m.findObjects(filepath.Join(root, "pool"), isDeb), nil
+}
+
+func (m *Memory) FindMetadata(ctx context.Context, root string) (findList []string, err error) {
+	return m.findKeys(filepath.Join(root, "pool"), isMetadata), nil
+}
@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"cmp"
+	"maps"
+	"path"
+	"strings"
+)
+
+// Headers are sent with a file when it is served.
+type Headers struct {
+	ContentType  string
+	CacheControl string
+}
+
+// Class of a file, which Options are chosen by.
+type Class string
+
+const (
+	ClassPool  Class = "pool"
+	ClassIndex Class = "index"
+	ClassLock  Class = "lock"
+)
+
+// Options are the encryption and the storage class S3 stores a file with.
+type Options struct {
+	// "aws:kms" or "AES256". "aws:kms" is used when SSEKMSKeyID is set.
+	ServerSideEncryption string
+	SSEKMSKeyID          string
+	StorageClass         string
+}
+
+// Policy decides the headers, the extra metadata and the options of the files
+// written, by their names.
+type Policy struct {
+	// CacheControl of the pool and by-hash files, which are never changed.
+	ImmutableCacheControl string
+	// CacheControl of Release, InRelease and Packages, which are replaced on
+	// publishing.
+	IndexCacheControl string
+	// Metadata is added to the metadata of every file.
+	Metadata map[string]string
+
+	// Options of every file, and the fields set in Classes by class.
+	Options Options
+	Classes map[Class]Options
+	// Class of every file, instead of the one by the name. The lockfile is
+	// not in the repository.
+	Class Class
+}
+
+// ClassOf returns the class of a file by its name, empty for the others.
+func ClassOf(name string) Class {
+	switch name = "/" + name; {
+	case strings.Contains(name, "/pool/"):
+		return ClassPool
+	case strings.Contains(name, "/dists/"), strings.Contains(name, "/snapshots/"):
+		return ClassIndex
+	}
+	return ""
+}
+
+// OptionsOf returns the options of a file, none for a nil Policy.
+func (p *Policy) OptionsOf(name string) (o Options) {
+	if p == nil {
+		return
+	}
+
+	class := p.Class
+	if class == "" {
+		class = ClassOf(name)
+	}
+
+	o = p.Options
+	if c, ok := p.Classes[class]; ok {
+		// the key id goes with the encryption of the class, AES256 takes none.
+		if c.ServerSideEncryption != "" || c.SSEKMSKeyID != "" {
+			o.ServerSideEncryption = c.ServerSideEncryption
+			o.SSEKMSKeyID = c.SSEKMSKeyID
+		}
+		o.StorageClass = cmp.Or(c.StorageClass, o.StorageClass)
+	}
+	if o.SSEKMSKeyID != "" && o.ServerSideEncryption == "" {
+		o.ServerSideEncryption = "aws:kms"
+	}
+	return
+}
+
+// Headers returns the headers of a file, none for a nil Policy.
+func (p *Policy) Headers(name string) (h Headers) {
+	if p == nil {
+		return
+	}
+
+	h.ContentType = ContentType(name)
+	switch {
+	case isImmutable(name):
+		h.CacheControl = p.ImmutableCacheControl
+	case isIndex(name):
+		h.CacheControl = p.IndexCacheControl
+	}
+	return
+}
+
+// apply adds the extra metadata to metadata of a file, which wins.
+func (p *Policy) apply(metadata map[string]string) map[string]string {
+	if p == nil || len(p.Metadata) == 0 {
+		return metadata
+	}
+	m := maps.Clone(p.Metadata)
+	maps.Copy(m, metadata)
+	return m
+}
+
+func isImmutable(name string) bool {
+	return strings.Contains("/"+name, "/by-hash/") || (strings.Contains("/"+name, "/pool/") && isDeb(name))
+}
+
+func isIndex(name string) bool {
+	switch base := path.Base(name); base {
+	case "Release", "InRelease", "Release.gpg":
+		return true
+	default:
+		return isPackages(base)
+	}
+}
+
+// ContentType returns the Content-Type of a file by its name, empty when it
+// is not known.
+func ContentType(name string) string {
+	base := path.Base(name)
+	switch {
+	case base == "Release.gpg":
+		return "application/pgp-signature"
+	case base == "Release", base == "InRelease", base == "Packages":
+		return "text/plain; charset=utf-8"
+	}
+
+	switch path.Ext(base) {
+	case ".deb":
+		return "application/vnd.debian.binary-package"
+	case ".gz":
+		return "application/gzip"
+	case ".bz2":
+		return "application/x-bzip2"
+	case ".xz":
+		return "application/x-xz"
+	case ".json":
+		return "application/json"
+	}
+	// by-hash files are served as the storage does by default.
+	return ""
+}
@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func TestPolicy(t *testing.T) {
+	p := &Policy{
+		ImmutableCacheControl: "max-age=31536000, immutable",
+		IndexCacheControl:     "no-cache",
+		Metadata:              map[string]string{"team": "sre"},
+	}
+
+	for name, want := range map[string]Headers{
+		"debian/pool/main/m/mkr/mkr_0.60.0_amd64.deb":                       {"application/vnd.debian.binary-package", "max-age=31536000, immutable"},
+		"debian/pool/main/m/mkr/mkr_0.60.0_amd64.deb.meta.json":             {"application/json", ""},
+		"debian/dists/stable/InRelease":                                     {"text/plain; charset=utf-8", "no-cache"},
+		"debian/dists/stable/Release.gpg":                                   {"application/pgp-signature", "no-cache"},
+		"debian/dists/stable/main/binary-amd64/Packages":                    {"text/plain; charset=utf-8", "no-cache"},
+		"debian/dists/stable/main/binary-amd64/Packages.gz":                 {"application/gzip", "no-cache"},
+		"debian/dists/stable/main/binary-amd64/by-hash/SHA256/0123456789ab": {"", "max-age=31536000, immutable"},
+		"snapshots/first/snapshot.json":                                     {"application/json", ""},
+	} {
+		if got := p.Headers(name); got != want {
+			t.Errorf("%s: %+v, want %+v", name, got, want)
+		}
+	}
+
+	if got := p.apply(map[string]string{"team": "apt", "apt-size": "3"}); !maps.Equal(got, map[string]string{"team": "apt", "apt-size": "3"}) {
+		t.Error(got)
+	}
+	if got := p.apply(nil); !maps.Equal(got, map[string]string{"team": "sre"}) {
+		t.Error(got)
+	}
+
+	var none *Policy
+	if got := none.Headers("debian/dists/stable/InRelease"); got != (Headers{}) {
+		t.Error(got)
+	}
+}
+
+func TestPolicyOptions(t *testing.T) {
+	p := &Policy{
+		Options: Options{SSEKMSKeyID: "alias/apt"},
+		Classes: map[Class]Options{
+			ClassPool:  {StorageClass: "STANDARD_IA"},
+			ClassIndex: {SSEKMSKeyID: "alias/index"},
+			ClassLock:  {ServerSideEncryption: "AES256"},
+		},
+	}
+
+	for name, want := range map[string]Options{
+		"debian/pool/main/m/mkr/mkr_0.60.0_amd64.deb": {"aws:kms", "alias/apt", "STANDARD_IA"},
+		"pool/main/m/mkr/mkr_0.60.0_amd64.deb":        {"aws:kms", "alias/apt", "STANDARD_IA"},
+		"debian/dists/stable/InRelease":               {"aws:kms", "alias/index", ""},
+	} {
+		if got := p.OptionsOf(name); got != want {
+			t.Errorf("%s: %+v, want %+v", name, got, want)
+		}
+	}
+
+	lock := *p
+	lock.Class = ClassLock
+	// the key id of the repository is not sent with AES256.
+	if got := lock.OptionsOf("lockfile"); got != (Options{"AES256", "", ""}) {
+		t.Errorf("lockfile: %+v", got)
+	}
+}
+
+func TestS3Policy(t *testing.T) {
+	var header http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Clone()
+		w.Header().Set("ETag", `"1"`)
+	}))
+	defer srv.Close()
+
+	fs := &S3{
+		S3Client: s3.New(s3.Options{
+			Region:       "us-east-1",
+			BaseEndpoint: aws.String(srv.URL),
+			UsePathStyle: true,
+			Credentials:  aws.AnonymousCredentials{},
+		}),
+		BucketName: "repository",
+		Policy: &Policy{
+			IndexCacheControl: "no-cache",
+			Metadata:          map[string]string{"team": "sre"},
+			Options:           Options{SSEKMSKeyID: "alias/apt", StorageClass: "STANDARD_IA"},
+		},
+	}
+	if err := fs.WriteFile(t.Context(), "debian/dists/stable/InRelease", []byte("signed"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for k, want := range map[string]string{
+		"Content-Type":                                "text/plain; charset=utf-8",
+		"Cache-Control":                               "no-cache",
+		"X-Amz-Meta-Team":                             "sre",
+		"X-Amz-Server-Side-Encryption":                "aws:kms",
+		"X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id": "alias/apt",
+		"X-Amz-Storage-Class":                         "STANDARD_IA",
+	} {
+		if got := header.Get(k); got != want {
+			t.Errorf("%s: %q, want %q", k, got, want)
+		}
+	}
+}
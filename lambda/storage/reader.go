@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	blockSize = 64 * 1024
+	maxBlocks = 16
+)
+
+// ReaderAt reads an object with Range requests. Blocks are cached, so small
+// reads such as ar(1) headers do not issue a request each.
+type ReaderAt struct {
+	ctx    context.Context
+	size   int64
+	object Object
+	// fetch returns the bytes from start to end, inclusive.
+	fetch func(ctx context.Context, start, end int64) (io.ReadCloser, error)
+
+	mu     sync.Mutex
+	blocks map[int64][]byte
+}
+
+// WithChecksumMode requests the checksum S3 stored for the object.
+func WithChecksumMode(input *s3.HeadObjectInput) {
+	input.ChecksumMode = types.ChecksumModeEnabled
+}
+
+func NewReaderAt(ctx context.Context, s3Client *s3.Client, bucket, key string, optFns ...func(*s3.HeadObjectInput)) (*ReaderAt, error) {
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	for _, fn := range optFns {
+		fn(input)
+	}
+
+	head, err := s3Client.HeadObject(ctx, input)
+	if err != nil {
+		return nil, s3Error(err)
+	}
+
+	object := headObject(key, head)
+	return newReaderAt(ctx, object, func(ctx context.Context, start, end int64) (io.ReadCloser, error) {
+		// the version which was stated is read, and a replaced one fails.
+		result, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket:  aws.String(bucket),
+			Key:     aws.String(key),
+			Range:   aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+			IfMatch: aws.String(quote(object.ETag)),
+		})
+		if err != nil {
+			return nil, s3Error(err)
+		}
+		return result.Body, nil
+	}), nil
+}
+
+func newReaderAt(ctx context.Context, object Object, fetch func(ctx context.Context, start, end int64) (io.ReadCloser, error)) *ReaderAt {
+	return &ReaderAt{
+		ctx:    ctx,
+		size:   object.Size,
+		object: object,
+		fetch:  fetch,
+		blocks: make(map[int64][]byte, maxBlocks),
+	}
+}
+
+func (r *ReaderAt) Size() int64 {
+	return r.size
+}
+
+// Object returns what the storage told about the object.
+func (r *ReaderAt) Object() Object {
+	return r.object
+}
+
+// Close releases nothing, each read is a request.
+func (r *ReaderAt) Close() error {
+	return nil
+}
+
+func (r *ReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset: %d", off)
+	}
+
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= r.size {
+			return n, io.EOF
+		}
+
+		block, err := r.block(pos / blockSize)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], block[pos%blockSize:])
+	}
+	return n, nil
+}
+
+func (r *ReaderAt) block(index int64) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if b, ok := r.blocks[index]; ok {
+		return b, nil
+	}
+
+	start := index * blockSize
+	end := min(start+blockSize, r.size) - 1
+
+	body, err := r.fetch(r.ctx, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	b := make([]byte, end-start+1)
+	if _, err := io.ReadFull(body, b); err != nil {
+		return nil, err
+	}
+
+	if len(r.blocks) >= maxBlocks {
+		clear(r.blocks)
+	}
+	r.blocks[index] = b
+	return b, nil
+}
+
+// Body returns the whole body of f as a stream, of the same version which f
+// reads.
+func Body(f File) (io.ReadCloser, error) {
+	r, ok := f.(*ReaderAt)
+	if !ok || r.size == 0 {
+		// local files are read through f.
+		return io.NopCloser(io.NewSectionReader(f, 0, f.Size())), nil
+	}
+	return r.fetch(r.ctx, 0, r.size-1)
+}
+
+// Open returns the whole object body as a stream.
+func Open(ctx context.Context, s3Client *s3.Client, bucket, key string) (io.ReadCloser, error) {
+	result, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	return result.Body, nil
+}
@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func TestReaderAt(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), blockSize/8+3)
+
+	var requests int
+	etag := `"v1"`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/bucket/key.deb" {
+			http.NotFound(w, r)
+			return
+		}
+		requests++
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, "key.deb", time.Time{}, bytes.NewReader(content))
+	}))
+	defer srv.Close()
+
+	client := s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(srv.URL),
+		UsePathStyle: true,
+		Credentials:  aws.AnonymousCredentials{},
+	})
+
+	r, err := NewReaderAt(t.Context(), client, "bucket", "key.deb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Size() != int64(len(content)) {
+		t.Fatalf("size: %d", r.Size())
+	}
+
+	b, err := io.ReadAll(io.NewSectionReader(r, 0, r.Size()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, content) {
+		t.Fatal("content does not match")
+	}
+
+	p := make([]byte, 60)
+	n, err := r.ReadAt(p, blockSize-30)
+	if err != nil || n != 60 || !bytes.Equal(p, content[blockSize-30:blockSize+30]) {
+		t.Fatal(n, err)
+	}
+
+	// HEAD and one request per block.
+	if requests != 1+3 {
+		t.Fatalf("requests: %d", requests)
+	}
+
+	n, err = r.ReadAt(p, r.Size()-10)
+	if err != io.EOF || n != 10 {
+		t.Fatal(n, err)
+	}
+
+	body, err := Body(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = io.ReadAll(body)
+	body.Close()
+	if err != nil || !bytes.Equal(b, content) {
+		t.Fatal("body does not match", err)
+	}
+
+	// the object is replaced since it was stated.
+	etag = `"v2"`
+	if _, err := Body(r); !IsConditionFailed(err) {
+		t.Fatal("replaced object is read", err)
+	}
+}
@@ -0,0 +1,268 @@
+package storage
+
+import (
+	"cmp"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"math"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+type stagedFile struct {
+	data     []byte
+	metadata map[string]string
+	deleted  bool
+	// cond of the first write with WriteFileIf, checked by Commit.
+	cond *Condition
+}
+
+// etag identifies the staged content, for the conditions of further writes.
+func (f stagedFile) etag() string {
+	sum := md5.Sum(f.data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (f stagedFile) object(name string) Object {
+	return Object{Key: name, Size: int64(len(f.data)), ETag: f.etag(), Metadata: f.metadata}
+}
+
+// Stage keeps the files written or deleted under prefix in memory, to publish
+// them at once with Commit. Other files are written through.
+type Stage struct {
+	Impl
+	prefix string
+
+	mu    sync.Mutex
+	files map[string]stagedFile
+}
+
+func NewStage(fs Impl, prefix string) *Stage {
+	return &Stage{
+		Impl:   fs,
+		prefix: prefix,
+		files:  make(map[string]stagedFile),
+	}
+}
+
+func (s *Stage) staged(name string) (stagedFile, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.files[name]
+	return f, ok
+}
+
+// Staged returns the names of the staged files.
+func (s *Stage) Staged() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Sorted(maps.Keys(s.files))
+}
+
+func (s *Stage) WriteFile(ctx context.Context, name string, data []byte, metadata map[string]string) error {
+	if !strings.HasPrefix(name, s.prefix+"/") {
+		return s.Impl.WriteFile(ctx, name, data, metadata)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[name] = stagedFile{data: data, metadata: metadata}
+	return nil
+}
+
+// WriteFileIf stages a file, to be written on Commit if cond is satisfied by
+// the file which was read. The condition on a staged file is checked at once.
+func (s *Stage) WriteFileIf(ctx context.Context, name string, data []byte, metadata map[string]string, cond Condition) (string, error) {
+	if !strings.HasPrefix(name, s.prefix+"/") {
+		return s.Impl.WriteFileIf(ctx, name, data, metadata, cond)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f := stagedFile{data: data, metadata: metadata, cond: &cond}
+	if current, ok := s.files[name]; ok {
+		exists := !current.deleted
+		if (cond.IfNoneMatch && exists) || (cond.IfMatch != "" && (!exists || current.etag() != cond.IfMatch)) {
+			return "", fmt.Errorf("%s: %w", name, ErrConditionFailed)
+		}
+		f.cond = current.cond
+	}
+	s.files[name] = f
+	return f.etag(), nil
+}
+
+func (s *Stage) DeleteFile(ctx context.Context, name string) error {
+	if !strings.HasPrefix(name, s.prefix+"/") {
+		return s.Impl.DeleteFile(ctx, name)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[name] = stagedFile{deleted: true}
+	return nil
+}
+
+func (s *Stage) ReadFile(ctx context.Context, name string) ([]byte, error) {
+	if f, ok := s.staged(name); ok {
+		if f.deleted {
+			return nil, fmt.Errorf("%s: %w", name, ErrNotExist)
+		}
+		return f.data, nil
+	}
+	return s.Impl.ReadFile(ctx, name)
+}
+
+func (s *Stage) GetFile(ctx context.Context, name string) ([]byte, Object, error) {
+	if f, ok := s.staged(name); ok {
+		if f.deleted {
+			return nil, Object{}, fmt.Errorf("%s: %w", name, ErrNotExist)
+		}
+		return f.data, f.object(name), nil
+	}
+	return s.Impl.GetFile(ctx, name)
+}
+
+func (s *Stage) ExistFile(ctx context.Context, name string) (bool, error) {
+	if f, ok := s.staged(name); ok {
+		return !f.deleted, nil
+	}
+	return s.Impl.ExistFile(ctx, name)
+}
+
+func (s *Stage) StatFile(ctx context.Context, name string) (Object, error) {
+	if f, ok := s.staged(name); ok {
+		if f.deleted {
+			return Object{}, fmt.Errorf("%s: %w", name, ErrNotExist)
+		}
+		return f.object(name), nil
+	}
+	return s.Impl.StatFile(ctx, name)
+}
+
+func (s *Stage) FindPackages(ctx context.Context, root string) (findList []string, err error) {
+	findList, err = s.Impl.FindPackages(ctx, root)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.merge(findList, func(name string) bool {
+		return strings.HasPrefix(name, filepath.Join(root, "dists")+"/") && strings.HasPrefix(filepath.Base(name), "Packages")
+	}), nil
+}
+
+func (s *Stage) FindFiles(ctx context.Context, root string) (findList []string, err error) {
+	findList, err = s.Impl.FindFiles(ctx, root)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.merge(findList, func(name string) bool {
+		return strings.HasPrefix(name, root+"/")
+	}), nil
+}
+
+// merge adds the staged files matching fn to findList, and removes the
+// deleted ones.
+func (s *Stage) merge(findList []string, fn func(name string) bool) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for name, f := range s.files {
+		if !f.deleted && fn(name) {
+			findList = append(findList, name)
+		}
+	}
+	findList = slices.DeleteFunc(findList, func(name string) bool {
+		return s.files[name].deleted
+	})
+	slices.Sort(findList)
+	return slices.Compact(findList)
+}
+
+// Discard drops the staged files.
+func (s *Stage) Discard() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clear(s.files)
+}
+
+type previousFile struct {
+	name   string
+	exist  bool
+	object Object
+	data   []byte
+}
+
+// Commit writes the staged files in the order of rank, then by name, and
+// deletes the files last. When a write fails, the files written before are
+// restored.
+func (s *Stage) Commit(ctx context.Context, rank func(name string) int) (err error) {
+	names := s.Staged()
+	order := func(name string) int {
+		if f, _ := s.staged(name); f.deleted {
+			return math.MaxInt
+		}
+		return rank(name)
+	}
+	slices.SortStableFunc(names, func(a, b string) int {
+		return cmp.Compare(order(a), order(b))
+	})
+
+	var written []previousFile
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, prev := range slices.Backward(written) {
+			if errR := s.restore(ctx, prev); errR != nil {
+				fmt.Println("can not restore", prev.name, errR)
+			}
+		}
+	}()
+
+	for _, name := range names {
+		prev := previousFile{name: name}
+		if prev.exist, err = s.Impl.ExistFile(ctx, name); err != nil {
+			return
+		}
+		if prev.exist {
+			if prev.object, err = s.Impl.StatFile(ctx, name); err != nil {
+				return
+			}
+			if prev.data, err = s.Impl.ReadFile(ctx, name); err != nil {
+				return
+			}
+		}
+
+		f, _ := s.staged(name)
+		if f.deleted {
+			if prev.exist {
+				err = s.Impl.DeleteFile(ctx, name)
+			}
+		} else if f.cond != nil {
+			_, err = s.Impl.WriteFileIf(ctx, name, f.data, f.metadata, *f.cond)
+		} else {
+			err = s.Impl.WriteFile(ctx, name, f.data, f.metadata)
+		}
+		if err != nil {
+			return
+		}
+		written = append(written, prev)
+	}
+
+	s.Discard()
+	return nil
+}
+
+func (s *Stage) restore(ctx context.Context, prev previousFile) error {
+	if !prev.exist {
+		return s.Impl.DeleteFile(ctx, prev.name)
+	}
+	return s.Impl.WriteFile(ctx, prev.name, prev.data, prev.object.Metadata)
+}
@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+)
+
+// failingMemory fails to write the file named fail.
+type failingMemory struct {
+	*Memory
+	fail string
+}
+
+func (m *failingMemory) WriteFile(ctx context.Context, name string, data []byte, metadata map[string]string) error {
+	if name == m.fail {
+		return errors.New("write failed")
+	}
+	return m.Memory.WriteFile(ctx, name, data, metadata)
+}
+
+func TestStage(t *testing.T) {
+	ctx := t.Context()
+
+	m := NewMemory()
+	if err := m.WriteFile(ctx, "dists/stable/Release", []byte("old"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WriteFile(ctx, "dists/stable/main/binary-amd64/Packages.bz2", []byte("old"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := &failingMemory{Memory: m}
+	stage := NewStage(fs, "dists/stable")
+
+	write := func(name, data string) {
+		t.Helper()
+		if err := stage.WriteFile(ctx, name, []byte(data), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("dists/stable/main/binary-amd64/Packages", "new")
+	write("dists/stable/Release", "new")
+	write("dists/stable/InRelease", "new")
+	write("pool/main/m/mkr/mkr.deb", "deb")
+	if err := stage.DeleteFile(ctx, "dists/stable/main/binary-amd64/Packages.bz2"); err != nil {
+		t.Fatal(err)
+	}
+
+	// staged files are visible through the stage only.
+	if exists(t, m, "dists/stable/main/binary-amd64/Packages") || !exists(t, stage, "dists/stable/main/binary-amd64/Packages") {
+		t.Fatal("Packages is not staged")
+	}
+	if !exists(t, m, "pool/main/m/mkr/mkr.deb") {
+		t.Fatal("pool file is staged")
+	}
+	list, err := stage.FindPackages(ctx, "")
+	if err != nil || !slices.Equal(list, []string{"dists/stable/main/binary-amd64/Packages"}) {
+		t.Fatal(list, err)
+	}
+
+	rank := func(name string) int {
+		if name == "dists/stable/InRelease" {
+			return 1
+		}
+		return 0
+	}
+
+	fs.fail = "dists/stable/InRelease"
+	if err := stage.Commit(ctx, rank); err == nil {
+		t.Fatal("commit does not fail")
+	}
+	if b, _ := m.ReadFile(ctx, "dists/stable/Release"); string(b) != "old" {
+		t.Fatalf("Release is not restored: %s", b)
+	}
+	if exists(t, m, "dists/stable/main/binary-amd64/Packages") || !exists(t, m, "dists/stable/main/binary-amd64/Packages.bz2") {
+		t.Fatal("Packages is not restored")
+	}
+
+	fs.fail = ""
+	if err := stage.Commit(ctx, rank); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := m.ReadFile(ctx, "dists/stable/InRelease"); string(b) != "new" {
+		t.Fatalf("InRelease is not written: %s", b)
+	}
+	if exists(t, m, "dists/stable/main/binary-amd64/Packages.bz2") {
+		t.Fatal("Packages.bz2 is not deleted")
+	}
+	if len(stage.Staged()) != 0 {
+		t.Fatal("files are still staged")
+	}
+}
+
+func TestStageConflict(t *testing.T) {
+	ctx := t.Context()
+
+	m := NewMemory()
+	if err := m.WriteFile(ctx, "dists/stable/Release", []byte("old"), nil); err != nil {
+		t.Fatal(err)
+	}
+	stage := NewStage(m, "dists/stable")
+
+	_, object, err := stage.GetFile(ctx, "dists/stable/Release")
+	if err != nil {
+		t.Fatal(err)
+	}
+	etag, err := stage.WriteFileIf(ctx, "dists/stable/Release", []byte("new"), nil, Condition{IfMatch: object.ETag})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stage.WriteFileIf(ctx, "dists/stable/Release", []byte("newer"), nil, Condition{IfMatch: object.ETag}); !IsConditionFailed(err) {
+		t.Fatal("staged file is written with a stale ETag", err)
+	}
+	if _, err := stage.WriteFileIf(ctx, "dists/stable/Release", []byte("newer"), nil, Condition{IfMatch: etag}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stage.WriteFileIf(ctx, "dists/stable/InRelease", []byte("new"), nil, Condition{IfNoneMatch: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// written by another writer before the commit.
+	if err := m.WriteFile(ctx, "dists/stable/Release", []byte("other"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	rank := func(name string) int {
+		if name == "dists/stable/Release" {
+			return 1
+		}
+		return 0
+	}
+	if err := stage.Commit(ctx, rank); !IsConditionFailed(err) {
+		t.Fatal("conflict is not detected", err)
+	}
+	if b, _ := m.ReadFile(ctx, "dists/stable/Release"); string(b) != "other" {
+		t.Fatalf("Release is overwritten: %s", b)
+	}
+	if exists(t, m, "dists/stable/InRelease") {
+		t.Fatal("InRelease is not restored")
+	}
+}
@@ -2,85 +2,329 @@ package storage
 
 import (
 	"bytes"
+	"cmp"
 	"context"
 	"errors"
 	"fmt"
 	"io"
-	"os"
+	"io/fs"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
 )
 
 type Impl interface {
-	ExistFile(ctx context.Context, name string) bool
+	// ExistFile reports whether a file exists. A missing file is not an error.
+	ExistFile(ctx context.Context, name string) (bool, error)
 	FindDeb(ctx context.Context, root string) (findList []string, err error)
+	ListDeb(ctx context.Context, root string) (objects []Object, err error)
+	FindMetadata(ctx context.Context, root string) (findList []string, err error)
+	StatFile(ctx context.Context, name string) (Object, error)
 	FindPackages(ctx context.Context, root string) (findList []string, err error)
+	FindFiles(ctx context.Context, root string) (findList []string, err error)
 	ReadFile(ctx context.Context, name string) ([]byte, error)
-	WriteFile(ctx context.Context, name string, data []byte) error
-	CopyFile(ctx context.Context, key string, source Source) error
+	// OpenFile opens a file for random access, Open for a sequential read.
+	OpenFile(ctx context.Context, name string) (File, error)
+	Open(ctx context.Context, name string) (io.ReadCloser, error)
+	WriteFile(ctx context.Context, name string, data []byte, metadata map[string]string) error
+	DeleteFile(ctx context.Context, name string) error
+	// GetFile reads a file with its ETag, to write or delete it conditionally.
+	GetFile(ctx context.Context, name string) ([]byte, Object, error)
+	WriteFileIf(ctx context.Context, name string, data []byte, metadata map[string]string, cond Condition) (etag string, err error)
+	DeleteFileIf(ctx context.Context, name, etag string) error
+	CopyFile(ctx context.Context, key string, source Source, metadata map[string]string) error
+	CopyFileIfAbsent(ctx context.Context, key string, source Source, metadata map[string]string) error
+}
+
+// ErrExist is returned when a file is not written as it already exists.
+var ErrExist = errors.New("file already exists")
+
+// ErrNotExist is wrapped by the errors of missing files.
+var ErrNotExist = fs.ErrNotExist
+
+// ErrConditionFailed is wrapped by the errors of conditional writes which were
+// not done.
+var ErrConditionFailed = errors.New("condition failed")
+
+// Condition of WriteFileIf.
+type Condition struct {
+	// IfNoneMatch writes only when the file does not exist.
+	IfNoneMatch bool
+	// IfMatch writes only when the ETag of the file matches.
+	IfMatch string
+}
+
+// File is a file opened for random access.
+type File interface {
+	io.ReaderAt
+	io.Closer
+	Size() int64
+	Object() Object
+}
+
+type Object struct {
+	Key      string
+	Size     int64
+	ETag     string
+	Metadata map[string]string
+	// LastModified is not set by listings.
+	LastModified time.Time
+
+	// ChecksumSHA256 is only set when it was requested with ChecksumMode.
+	ChecksumSHA256 string
+
+	// Headers are not set by listings.
+	Headers Headers
 }
 
 type S3 struct {
 	S3Client   *s3.Client
 	BucketName string
+
+	// request the checksum S3 stored for the files opened with OpenFile.
+	ChecksumMode bool
+
+	// Policy sets the headers of the files written, nil for none.
+	Policy *Policy
+
+	// CopyFile copies the files larger than CopyThreshold in parts of
+	// CopyPartSize. The defaults are used when they are zero.
+	CopyThreshold int64
+	CopyPartSize  int64
+}
+
+var _ Impl = (*S3)(nil)
+
+func (s *S3) OpenFile(ctx context.Context, name string) (File, error) {
+	var optFns []func(*s3.HeadObjectInput)
+	if s.ChecksumMode {
+		optFns = append(optFns, WithChecksumMode)
+	}
+	return NewReaderAt(ctx, s.S3Client, s.BucketName, name, optFns...)
+}
+
+func (s *S3) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	return Open(ctx, s.S3Client, s.BucketName, name)
 }
 
-func (s *S3) WriteFile(ctx context.Context, name string, data []byte) error {
-	_, err := s.S3Client.PutObject(ctx, &s3.PutObjectInput{
+func (s *S3) WriteFile(ctx context.Context, name string, data []byte, metadata map[string]string) error {
+	_, err := s.WriteFileIf(ctx, name, data, metadata, Condition{})
+	return err
+}
+
+func (s *S3) DeleteFile(ctx context.Context, name string) error {
+	_, err := s.S3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
 		Bucket: aws.String(s.BucketName),
 		Key:    aws.String(name),
-		Body:   bytes.NewReader(data),
 	})
 	return err
 }
 
 type Source struct {
 	Bucket, Key string
+
+	// ChecksumSHA256 is the checksum S3 stored for the source, if any.
+	ChecksumSHA256 string
+	// Object of the source as it was read, which S3 copies only if it is not
+	// changed since. The source is stated with the client of the repository
+	// when it is nil, which may not be allowed to.
+	Object *Object
 }
 
-func (s *S3) CopyFile(ctx context.Context, key string, source Source) error {
-	_, err := s.S3Client.CopyObject(ctx, &s3.CopyObjectInput{
-		Bucket:     aws.String(s.BucketName),
-		CopySource: aws.String(fmt.Sprintf("%v/%v", source.Bucket, source.Key)),
-		Key:        aws.String(key),
-	})
+// CopyFile copies source to key. When metadata is given, it replaces the
+// metadata of the source.
+func (s *S3) CopyFile(ctx context.Context, key string, source Source, metadata map[string]string) error {
+	src, err := s.sourceObject(ctx, source)
+	if err != nil {
+		return err
+	}
+	if src.Size > cmp.Or(s.CopyThreshold, DefaultCopyThreshold) {
+		return s.copyParts(ctx, key, source, src, metadata, false)
+	}
+
+	options := s.Policy.OptionsOf(key)
+	input := &s3.CopyObjectInput{
+		Bucket:               aws.String(s.BucketName),
+		CopySource:           copySource(source),
+		CopySourceIfMatch:    aws.String(quote(src.ETag)),
+		Key:                  aws.String(key),
+		ServerSideEncryption: types.ServerSideEncryption(options.ServerSideEncryption),
+		SSEKMSKeyId:          optional(options.SSEKMSKeyID),
+		StorageClass:         types.StorageClass(options.StorageClass),
+	}
+	if s.Policy != nil && metadata == nil {
+		// the metadata of the source is kept, with the headers replaced.
+		metadata = src.Metadata
+	}
+	if metadata != nil {
+		headers := s.Policy.Headers(key)
+		input.Metadata = s.Policy.apply(metadata)
+		input.MetadataDirective = types.MetadataDirectiveReplace
+		input.ContentType = optional(headers.ContentType)
+		input.CacheControl = optional(headers.CacheControl)
+	}
+
+	_, err = s.S3Client.CopyObject(ctx, input)
 
 	return err
 }
 
-func (s *S3) ExistFile(ctx context.Context, name string) bool {
-	_, err := s.S3Client.HeadObject(ctx, &s3.HeadObjectInput{
+// CopyFileIfAbsent copies source to key if key does not exist. It is copied
+// in parts of any size, as CopyObject can not be conditional on key, and
+// CompleteMultipartUpload can.
+func (s *S3) CopyFileIfAbsent(ctx context.Context, key string, source Source, metadata map[string]string) error {
+	src, err := s.sourceObject(ctx, source)
+	if err != nil {
+		return err
+	}
+	return s.copyParts(ctx, key, source, src, metadata, true)
+}
+
+func (s *S3) ExistFile(ctx context.Context, name string) (bool, error) {
+	_, err := s.StatFile(ctx, name)
+	return exist(err)
+}
+
+func (s *S3) StatFile(ctx context.Context, name string) (Object, error) {
+	result, err := s.S3Client.HeadObject(ctx, &s3.HeadObjectInput{
 		Bucket: aws.String(s.BucketName),
 		Key:    aws.String(name),
 	})
 	if err != nil {
-		var noKey *types.NoSuchKey
-		if errors.As(err, &noKey) {
-			return false
-		}
-		return false // TODO
+		return Object{}, s3Error(err)
+	}
+	return headObject(name, result), nil
+}
+
+func headObject(key string, result *s3.HeadObjectOutput) Object {
+	return Object{
+		Key:            key,
+		Size:           aws.ToInt64(result.ContentLength),
+		ETag:           strings.Trim(aws.ToString(result.ETag), `"`),
+		Metadata:       result.Metadata,
+		LastModified:   aws.ToTime(result.LastModified),
+		ChecksumSHA256: aws.ToString(result.ChecksumSHA256),
+		Headers: Headers{
+			ContentType:  aws.ToString(result.ContentType),
+			CacheControl: aws.ToString(result.CacheControl),
+		},
 	}
-	return true
 }
 
 func (s *S3) ReadFile(ctx context.Context, name string) ([]byte, error) {
+	b, _, err := s.GetFile(ctx, name)
+	return b, err
+}
+
+func (s *S3) GetFile(ctx context.Context, name string) ([]byte, Object, error) {
 	result, err := s.S3Client.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(s.BucketName),
 		Key:    aws.String(name),
 	})
 	if err != nil {
-		return nil, err
+		return nil, Object{}, s3Error(err)
 	}
 	defer result.Body.Close()
-	return io.ReadAll(result.Body)
+
+	b, err := io.ReadAll(result.Body)
+	if err != nil {
+		return nil, Object{}, err
+	}
+	return b, Object{
+		Key:          name,
+		Size:         int64(len(b)),
+		ETag:         strings.Trim(aws.ToString(result.ETag), `"`),
+		Metadata:     result.Metadata,
+		LastModified: aws.ToTime(result.LastModified),
+		Headers: Headers{
+			ContentType:  aws.ToString(result.ContentType),
+			CacheControl: aws.ToString(result.CacheControl),
+		},
+	}, nil
+}
+
+func (s *S3) WriteFileIf(ctx context.Context, name string, data []byte, metadata map[string]string, cond Condition) (string, error) {
+	headers, options := s.Policy.Headers(name), s.Policy.OptionsOf(name)
+	input := &s3.PutObjectInput{
+		Bucket:               aws.String(s.BucketName),
+		Key:                  aws.String(name),
+		Body:                 bytes.NewReader(data),
+		Metadata:             s.Policy.apply(metadata),
+		ContentType:          optional(headers.ContentType),
+		CacheControl:         optional(headers.CacheControl),
+		ServerSideEncryption: types.ServerSideEncryption(options.ServerSideEncryption),
+		SSEKMSKeyId:          optional(options.SSEKMSKeyID),
+		StorageClass:         types.StorageClass(options.StorageClass),
+	}
+	if cond.IfNoneMatch {
+		input.IfNoneMatch = aws.String("*")
+	}
+	if cond.IfMatch != "" {
+		input.IfMatch = aws.String(quote(cond.IfMatch))
+	}
+
+	output, err := s.S3Client.PutObject(ctx, input)
+	if err != nil {
+		return "", s3Error(err)
+	}
+	return strings.Trim(aws.ToString(output.ETag), `"`), nil
+}
+
+func (s *S3) DeleteFileIf(ctx context.Context, name, etag string) error {
+	_, err := s.S3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket:  aws.String(s.BucketName),
+		Key:     aws.String(name),
+		IfMatch: aws.String(quote(etag)),
+	})
+	return s3Error(err)
+}
+
+// optional omits an empty header.
+func optional(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func quote(etag string) string {
+	return `"` + strings.Trim(etag, `"`) + `"`
+}
+
+// s3Error wraps the errors of missing objects and failed conditions with
+// ErrNotExist and ErrConditionFailed.
+func s3Error(err error) error {
+	var noKey *types.NoSuchKey
+	var notFound *types.NotFound
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &noKey), errors.As(err, &notFound):
+		return fmt.Errorf("%w: %w", ErrNotExist, err)
+	case IsConditionFailed(err):
+		return fmt.Errorf("%w: %w", ErrConditionFailed, err)
+	}
+	return err
 }
 
 func (s *S3) findKeys(ctx context.Context, prefix string, fn func(key string) bool) (findList []string, err error) {
+	objects, err := s.findObjects(ctx, prefix, fn)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, object := range objects {
+		findList = append(findList, object.Key)
+	}
+	return
+}
+
+func (s *S3) findObjects(ctx context.Context, prefix string, fn func(key string) bool) (objects []Object, err error) {
 	objectPaginator := s3.NewListObjectsV2Paginator(s.S3Client, &s3.ListObjectsV2Input{
 		Bucket: aws.String(s.BucketName),
 		Prefix: aws.String(prefix),
@@ -88,16 +332,16 @@ func (s *S3) findKeys(ctx context.Context, prefix string, fn func(key string) bo
 	for objectPaginator.HasMorePages() {
 		output, err := objectPaginator.NextPage(ctx)
 		if err != nil {
-			var noBucket *types.NoSuchBucket
-			if errors.As(err, &noBucket) {
-				return nil, noBucket
-			}
-			break
+			return nil, err
 		}
 
 		for _, content := range output.Contents {
 			if fn(*content.Key) {
-				findList = append(findList, *content.Key)
+				objects = append(objects, Object{
+					Key:  aws.ToString(content.Key),
+					Size: aws.ToInt64(content.Size),
+					ETag: strings.Trim(aws.ToString(content.ETag), `"`),
+				})
 			}
 		}
 	}
@@ -106,36 +350,66 @@ func (s *S3) findKeys(ctx context.Context, prefix string, fn func(key string) bo
 }
 
 func (s *S3) FindPackages(ctx context.Context, root string) (findList []string, err error) {
-	return s.findKeys(ctx, filepath.Join(root, "dists"), func(key string) bool {
-		return strings.HasPrefix(filepath.Base(key), "Packages")
-	})
+	return s.findKeys(ctx, filepath.Join(root, "dists"), isPackages)
+}
+
+func (s *S3) FindFiles(ctx context.Context, root string) (findList []string, err error) {
+	return s.findKeys(ctx, root, func(string) bool { return true })
 }
 
 func (s *S3) FindDeb(ctx context.Context, root string) (findList []string, err error) {
-	return s.findKeys(ctx, filepath.Join(root, "pool"), func(key string) bool {
-		return strings.HasSuffix(filepath.Base(key), ".deb")
-	})
+	return s.findKeys(ctx, filepath.Join(root, "pool"), isDeb)
 }
 
-func Download(ctx context.Context, s3Client *s3.Client, bucket, key string) (fn string, err error) {
-	f, err := os.CreateTemp("", "temp*")
-	if err != nil {
-		return
-	}
-	fn = f.Name()
+func (s *S3) ListDeb(ctx context.Context, root string) (objects []Object, err error) {
+	return s.findObjects(ctx, filepath.Join(root, "pool"), isDeb)
+}
 
-	downloader := manager.NewDownloader(s3Client)
-	_, err = downloader.Download(ctx, f, &s3.GetObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
-	})
-	if err != nil {
-		return
+func (s *S3) FindMetadata(ctx context.Context, root string) (findList []string, err error) {
+	return s.findKeys(ctx, filepath.Join(root, "pool"), isMetadata)
+}
+
+func isDeb(key string) bool {
+	return strings.HasSuffix(filepath.Base(key), ".deb")
+}
+
+func isPackages(key string) bool {
+	return strings.HasPrefix(filepath.Base(key), "Packages")
+}
+
+// MetadataSuffix is appended to a pool file key to get its metadata sidecar.
+const MetadataSuffix = ".meta.json"
+
+func isMetadata(key string) bool {
+	return strings.HasSuffix(key, MetadataSuffix)
+}
+
+// IsNotExist reports whether a file is missing.
+func IsNotExist(err error) bool {
+	return errors.Is(err, ErrNotExist)
+}
+
+// exist is the result of ExistFile for the error of StatFile.
+func exist(err error) (bool, error) {
+	if IsNotExist(err) {
+		return false, nil
 	}
-	err = f.Close()
-	if err != nil {
-		return
+	return err == nil, err
+}
+
+// IsConditionFailed reports whether a conditional request was not satisfied.
+func IsConditionFailed(err error) bool {
+	if errors.Is(err, ErrConditionFailed) {
+		return true
 	}
 
-	return
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.ErrorCode() {
+	case "PreconditionFailed", "ConditionalRequestConflict":
+		return true
+	}
+	return false
 }
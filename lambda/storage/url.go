@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	gcs "cloud.google.com/go/storage"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Resolver returns the storage of a bucket by the scheme of its URL,
+// s3://bucket/key, gs://bucket/key, az://container/key or file:///path. The
+// client of a scheme is nil when it is not used.
+type Resolver struct {
+	S3           *s3.Client
+	ChecksumMode bool
+	// Policy sets the headers of the files written.
+	Policy *Policy
+
+	GCS   *gcs.Client
+	Azure *azblob.Client
+}
+
+func (r *Resolver) Bucket(scheme, bucket string) (Impl, error) {
+	switch {
+	case scheme == "s3" && r.S3 != nil:
+		return &S3{S3Client: r.S3, BucketName: bucket, ChecksumMode: r.ChecksumMode, Policy: r.Policy}, nil
+	case scheme == "gs" && r.GCS != nil:
+		return &GCS{Client: r.GCS, Bucket: bucket, Policy: r.Policy}, nil
+	case scheme == "az" && r.Azure != nil:
+		return &Azure{Client: r.Azure, Container: bucket, Policy: r.Policy}, nil
+	case scheme == "file":
+		return &Local{Dir: bucket}, nil
+	}
+	return nil, fmt.Errorf("unsupported storage: %s://%s", scheme, bucket)
+}
+
+// Parse returns the storage of the bucket of rawurl, and the key in it.
+func (r *Resolver) Parse(rawurl string) (Impl, string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if u.Scheme == "file" {
+		dir, key := filepath.Split(u.Path)
+		fs, err := r.Bucket(u.Scheme, dir)
+		return fs, key, err
+	}
+
+	fs, err := r.Bucket(u.Scheme, u.Host)
+	return fs, strings.TrimPrefix(u.Path, "/"), err
+}
+
+// ReadURL reads the file of rawurl.
+func (r *Resolver) ReadURL(ctx context.Context, rawurl string) ([]byte, error) {
+	fs, key, err := r.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	return fs.ReadFile(ctx, key)
+}
@@ -0,0 +1,11 @@
+#!/bin/sh
+
+awslocal dynamodb create-table \
+    --table-name lock \
+    --attribute-definitions AttributeName=LockKey,AttributeType=S \
+    --key-schema AttributeName=LockKey,KeyType=HASH \
+    --billing-mode PAY_PER_REQUEST
+
+awslocal dynamodb update-time-to-live \
+    --table-name lock \
+    --time-to-live-specification Enabled=true,AttributeName=ExpiresAt